@@ -2,6 +2,7 @@ package mysqlbinlog
 
 import (
 	"context"
+	"fmt"
 	"log"
 
 	"github.com/siddontang/go-mysql/mysql"
@@ -43,15 +44,19 @@ func (s *myBinEvent) checkBinEvent(cfg *ConfCmd, ev *replication.BinlogEvent, cu
 	}
 }
 
-var eventChan = make(chan myBinEvent, 100)
-
-func startListenBinEvents(pos mysql.Position) {
-	defer close(eventChan)
-	replStreamer := newBinlogStreamer(pos)
-	sendBinlogEvent(replStreamer, eventChan)
+func startListenBinEvents(p *pipeline, pos mysql.Position) {
+	defer close(p.events)
+	replStreamer, err := newBinlogStreamer(pos)
+	if err != nil {
+		p.setErr(err)
+		return
+	}
+	if err := sendBinlogEvent(replStreamer, p); err != nil {
+		p.setErr(err)
+	}
 }
 
-func newBinlogStreamer(pos mysql.Position) *replication.BinlogStreamer {
+func newBinlogStreamer(pos mysql.Position) (*replication.BinlogStreamer, error) {
 	replCfg := replication.BinlogSyncerConfig{
 		ServerID:                1113306,
 		Flavor:                  "mysql",
@@ -70,12 +75,12 @@ func newBinlogStreamer(pos mysql.Position) *replication.BinlogStreamer {
 
 	replStreamer, err := replSyncer.StartSync(pos)
 	if err != nil {
-		log.Fatalf("error replication from master %s:%d ", confCmd.Host, confCmd.Port)
+		return nil, fmt.Errorf("error replication from master %s:%d, err=%s", confCmd.Host, confCmd.Port, err.Error())
 	}
-	return replStreamer
+	return replStreamer, nil
 }
 
-func sendBinlogEvent(streamer *replication.BinlogStreamer, eventChan chan myBinEvent) {
+func sendBinlogEvent(streamer *replication.BinlogStreamer, p *pipeline) error {
 	log.Println("start to get binlog from mysql")
 
 	var (
@@ -88,7 +93,7 @@ func sendBinlogEvent(streamer *replication.BinlogStreamer, eventChan chan myBinE
 	for {
 		ev, err := streamer.GetEvent(context.Background())
 		if err != nil {
-			log.Fatalf("error to get binlog event, err=%s", err)
+			return fmt.Errorf("error to get binlog event, err=%s", err)
 		}
 
 		if ev.Header.EventType == replication.TABLE_MAP_EVENT {
@@ -118,7 +123,12 @@ func sendBinlogEvent(streamer *replication.BinlogStreamer, eventChan chan myBinE
 			}
 
 			oneMyEvent.SqlType = sqlType
-			eventChan <- *oneMyEvent
+			select {
+			case p.events <- *oneMyEvent:
+			case <-p.done:
+				// the generator has stopped, nobody will consume the event
+				return nil
+			}
 		} else {
 			log.Printf("this should not happen: return value of CheckBinEvent() is %d\n", chkRe)
 		}
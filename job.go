@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -41,8 +42,9 @@ func Start(host string, port uint, user string, password string, duration time.D
 	}
 
 	rollbackSQL.lastUpdate = time.Now()
-	go startListenBinEvents(pos)
-	go startGenRollbackSql()
+	p := newPipeline()
+	go startListenBinEvents(p, pos)
+	go startGenRollbackSql(p)
 	return nil
 }
 
@@ -52,16 +54,91 @@ func Stop() {
 	}
 }
 
-func Rollback() {
-	con := getDBCon()
+func Rollback() error {
+	if err := Err(); err != nil {
+		return err
+	}
+	con, err := getDBCon()
+	if err != nil {
+		return err
+	}
 	sql := rollbackSQL.concatRollbackSQL()
 	if len(strings.Trim(sql, " \r\n")) != 0 {
 		if _, err := con.Exec(sql); err != nil {
-			log.Fatalf("failed to rollback sql, sql= %s err=%s", sql, err.Error())
+			return fmt.Errorf("failed to rollback sql, sql= %s err=%s", sql, err.Error())
 		}
 	}
+	return nil
 }
 
-func Begin() {
+func Begin() error {
+	if err := Err(); err != nil {
+		return err
+	}
 	rollbackSQL.reset()
+	return nil
+}
+
+// pipeline is the state of the background listener and generator of one Start, a failed pipeline
+// does not leak into the next Start
+type pipeline struct {
+	errOnce sync.Once
+	err     error           // sticky error of the listener and generator
+	done    chan struct{}   // closed when err is set
+	events  chan myBinEvent // from the listener to the generator
+}
+
+var (
+	pipelineMu      sync.Mutex
+	currentPipeline *pipeline // the pipeline of the last Start
+)
+
+// newPipeline returns a fresh pipeline and makes it the one Err and Done report on
+func newPipeline() *pipeline {
+	p := &pipeline{
+		done:   make(chan struct{}),
+		events: make(chan myBinEvent, 100),
+	}
+	pipelineMu.Lock()
+	currentPipeline = p
+	pipelineMu.Unlock()
+	return p
+}
+
+func getPipeline() *pipeline {
+	pipelineMu.Lock()
+	defer pipelineMu.Unlock()
+	return currentPipeline
+}
+
+// Err returns the error that stopped the background binlog listener or generator of the last Start,
+// nil if they are still running or Start was not called.
+func Err() error {
+	p := getPipeline()
+	if p == nil {
+		return nil
+	}
+	select {
+	case <-p.done:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// Done is closed when the background binlog listener or generator of the last Start fails, Err tells the reason.
+// It is nil before Start.
+func Done() <-chan struct{} {
+	if p := getPipeline(); p != nil {
+		return p.done
+	}
+	return nil
+}
+
+func (p *pipeline) setErr(err error) {
+	p.errOnce.Do(func() {
+		log.Printf("binlog pipeline stopped, err=%s", err.Error())
+		p.err = err
+		close(p.done)
+	})
 }
@@ -15,19 +15,28 @@ import (
 )
 
 func disableBinlog() error {
-	con := getDBCon()
-	_, err := con.Exec(disableBinlogSQL)
+	con, err := getDBCon()
+	if err != nil {
+		return err
+	}
+	_, err = con.Exec(disableBinlogSQL)
 	return err
 }
 
 func disableKeyCheck() error {
-	con := getDBCon()
-	_, err := con.Exec(disableKeyCheckSQL)
+	con, err := getDBCon()
+	if err != nil {
+		return err
+	}
+	_, err = con.Exec(disableKeyCheckSQL)
 	return err
 }
 
 func getCurrentPosition() (pos mysql.Position, err error) {
-	con := getDBCon()
+	con, err := getDBCon()
+	if err != nil {
+		return pos, err
+	}
 	var res [5]string
 	if err := con.QueryRow(showMasterStatusSQL).Scan(&res[0], &res[1], &res[2], &res[3], &res[4]); err != nil {
 		return pos, err
@@ -96,17 +105,17 @@ func (s tablesColumnsInfo) getTableInfo(schema string, table string, binlog stri
 
 var sqlCon *sql.DB
 
-func getDBCon() *sql.DB {
+func getDBCon() (*sql.DB, error) {
 	if sqlCon != nil {
-		return sqlCon
+		return sqlCon, nil
 	}
 	sqlUrl := mysqlUrl()
 	con, err := connectMysql(sqlUrl)
 	if err != nil {
-		log.Fatalf("fail to connect to mysql, err=%s", err.Error())
+		return nil, fmt.Errorf("fail to connect to mysql, err=%s", err.Error())
 	}
 	sqlCon = con
-	return sqlCon
+	return sqlCon, nil
 }
 
 func getColIndexFromKey(ki keyInfo, columns []fieldInfo) []int {
@@ -142,7 +151,10 @@ func (s *tablesColumnsInfo) checkAndCreateTblKey(schema, table string) bool {
 }
 
 func (s *tablesColumnsInfo) getTableFields(dbTbs map[string][]string, batchCnt int) error {
-	con := getDBCon()
+	con, err := getDBCon()
+	if err != nil {
+		return err
+	}
 	var (
 		dbName         string
 		tbName         string
@@ -201,7 +213,10 @@ func (s *tablesColumnsInfo) getTableFields(dbTbs map[string][]string, batchCnt i
 }
 
 func (s *tablesColumnsInfo) getTableKeys(dbTbs map[string][]string, batchCnt int) (err error) {
-	con := getDBCon()
+	con, err := getDBCon()
+	if err != nil {
+		return err
+	}
 	var (
 		dbName, tbName, kName, colName, ktype string
 		colPos                                int
@@ -317,7 +332,10 @@ func (s *tablesColumnsInfo) getTableKeys(dbTbs map[string][]string, batchCnt int
 }
 
 func (s *tablesColumnsInfo) getTableAutoIncrements(dbTbs map[string][]string, batchCnt int) error {
-	con := getDBCon()
+	con, err := getDBCon()
+	if err != nil {
+		return err
+	}
 	log.Println("getting auto_increments from mysql")
 	querySqls := getFieldOrKeyQuerySqls(autoIncrementsSQL, dbTbs, batchCnt)
 	for _, oneQuery := range querySqls {
@@ -395,7 +413,12 @@ func getTableNames() (map[string][]string, error) {
 		dbTables = map[string][]string{}
 	)
 
-	rows, err := getDBCon().Query(getTableNamesSQL)
+	con, err := getDBCon()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := con.Query(getTableNamesSQL)
 	if err != nil {
 		return nil, err
 	}
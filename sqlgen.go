@@ -1,6 +1,7 @@
 package mysqlbinlog
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -109,7 +110,13 @@ var rollbackSQL = &RollbackSQL{
 	Mutex:      &sync.Mutex{},
 }
 
-func startGenRollbackSql() {
+func startGenRollbackSql(p *pipeline) {
+	if err := genRollbackSql(p.events); err != nil {
+		p.setErr(err)
+	}
+}
+
+func genRollbackSql(events <-chan myBinEvent) error {
 	var (
 		err            error
 		tbInfo         *tblInfoJson
@@ -125,7 +132,7 @@ func startGenRollbackSql() {
 	)
 	log.Print("start to generate rollback sql")
 
-	for ev := range eventChan {
+	for ev := range events {
 		if !ev.IfRowsEvent {
 			continue
 		}
@@ -142,19 +149,19 @@ func startGenRollbackSql() {
 		for {
 			tbInfo, err = tableinfo.getTableInfo(db, tb, ev.MyPos.Name, ev.StartPos, ev.MyPos.Pos)
 			if err != nil {
-				log.Fatalf("error to found %s table structure for event %s", fulltb, posStr)
+				return fmt.Errorf("error to found %s table structure for event %s", fulltb, posStr)
 			}
 			// when new table added, we need to update the table defination via `getTableInfo` and retry
 			if tbInfo == nil {
 				msg := fmt.Sprintf("no suitable table struct found for %s for event %s", fulltb, posStr)
 
 				if !canRetry {
-					log.Fatalf(msg)
+					return errors.New(msg)
 				}
 
 				canRetry = false
 				if err = getTableInfo(); err != nil {
-					log.Fatalf(err.Error())
+					return err
 				}
 				continue
 			}
@@ -175,13 +182,13 @@ func startGenRollbackSql() {
 				len(colsTypeName), len(tbInfo.Columns), fulltb, ev.MyPos.String(), spew.Sdump(tbInfo.Columns), spew.Sdump(ev.BinEvent.Rows[0]))
 
 			if !canRetry {
-				log.Fatalf(msg)
+				return errors.New(msg)
 			}
 
 			canRetry = false
 			log.Println(msg)
 			if err = getTableInfo(); err != nil {
-				log.Fatalf(err.Error())
+				return err
 			}
 		}
 
@@ -197,7 +204,7 @@ func startGenRollbackSql() {
 						}
 						txtStr, coOk := ev.BinEvent.Rows[ri][ci].([]byte)
 						if !coOk {
-							log.Fatalf("fail to convert %s to []byte type", ev.BinEvent.Rows[ri][ci])
+							return fmt.Errorf("fail to convert %v to []byte type", ev.BinEvent.Rows[ri][ci])
 						} else {
 							ev.BinEvent.Rows[ri][ci] = string(txtStr)
 						}
@@ -226,6 +233,7 @@ func startGenRollbackSql() {
 		}
 		rollbackSQL.append(sqls)
 	}
+	return nil
 }
 
 func filterStoredGeneratedFields(names []fieldInfo, rows [][]interface{}) ([]fieldInfo, [][]interface{}) {
@@ -0,0 +1,94 @@
+package mysqlbinlog
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Checkpoint is a named savepoint inside a rollback cycle, it is created by Session.Checkpoint
+// and restored by Session.RollbackTo. Checkpoints nest, restoring one discards the checkpoints created after it.
+type Checkpoint struct {
+	Name     string
+	MarkerID int64  // the marker inserted when the checkpoint is created
+	GTIDSet  string // GTID set executed up to the marker, empty without gtid_mode
+}
+
+// cycleFrame holds the rollback entries collected since Begin or a checkpoint, until the next checkpoint
+type cycleFrame struct {
+	checkpoint Checkpoint // zero for the frame started by Begin
+	entries    []rollbackEntry
+}
+
+// frameEntries returns the entries of frames[idx:] in binlog order
+func (s *Session) frameEntries(idx int) []rollbackEntry {
+	var entries []rollbackEntry
+	for _, f := range s.frames[idx:] {
+		entries = append(entries, f.entries...)
+	}
+	return entries
+}
+
+func (s *Session) findFrame(cp Checkpoint) (int, error) {
+	for i := len(s.frames) - 1; i > 0; i-- {
+		if s.frames[i].checkpoint == cp {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("checkpoint %s(marker ID %d) not found, it is discarded by Begin, Rollback or rolling back to an outer checkpoint", cp.Name, cp.MarkerID)
+}
+
+// Checkpoint creates a named savepoint, RollbackTo reverts the changes made after it.
+func (s *Session) Checkpoint(name string) (Checkpoint, error) {
+	return s.CheckpointContext(context.Background(), name)
+}
+
+// CheckpointContext is Checkpoint with a context to bound the wait for the marker.
+func (s *Session) CheckpointContext(ctx context.Context, name string) (Checkpoint, error) {
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	markerID, err := s.syncMarker(ctx)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	cp := Checkpoint{Name: name, MarkerID: markerID, GTIDSet: s.LastGTIDSet()}
+	s.frames = append(s.frames, &cycleFrame{checkpoint: cp})
+	logrus.Infof("checkpoint %s created with markerID=%d, depth=%d", name, markerID, len(s.frames)-1)
+	return cp, nil
+}
+
+// RollbackTo reverts the changes made after cp, the checkpoints created after cp are discarded.
+// cp itself is kept, so it can be restored again. Verify mode does not check it, the checksums are taken at Begin.
+func (s *Session) RollbackTo(cp Checkpoint) error {
+	return s.RollbackToContext(context.Background(), cp)
+}
+
+// RollbackToContext is RollbackTo with a context to bound the wait for the marker and the execution of rollback SQLs.
+func (s *Session) RollbackToContext(ctx context.Context, cp Checkpoint) error {
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	idx, err := s.findFrame(cp)
+	if err != nil {
+		return err
+	}
+
+	markerID, err := s.syncMarker(ctx)
+	if err != nil {
+		return err
+	}
+	entries := s.frameEntries(idx)
+	execErr := s.execRollback(ctx, markerID, entries, false)
+	if !isIrreversible(execErr) {
+		return execErr
+	}
+	s.frames = s.frames[:idx+1]
+	s.frames[idx].entries = nil
+	if err := s.journal.done(entries); err != nil {
+		return fmt.Errorf("rollback executed, but failed to record it in the journal, err=%w", err)
+	}
+	return execErr
+}
@@ -1,18 +1,25 @@
 package mysqlbinlog
 
 import (
-	"fmt"
+	"context"
+	"database/sql"
+	"errors"
 	"os"
-	"strings"
-	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 const markerDatabaseName = "_mysqlbinlog_marker_db"
-const markerDatabaseTableFullName = "_mysqlbinlog_marker_db.marker"
+const markerDatabaseTableFullName = "_mysqlbinlog_marker_db.session_marker"
+const shadowDatabaseName = "_mysqlbinlog_shadow_db"
 
-func Start(host string, port uint, user string, password string) error {
+// defaultSession backs the package-level functions below
+var defaultSession *Session
+
+// ErrNotStarted is returned by the package-level functions when Start() is not called
+var ErrNotStarted = errors.New("mysqlbinlog is not started, call Start() first")
+
+func Start(host string, port uint, user string, password string, opts ...Option) error {
 	// Configure logrus
 	logrus.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
@@ -20,94 +27,109 @@ func Start(host string, port uint, user string, password string) error {
 	logrus.SetOutput(os.Stdout)       // You can change to a file for file logging
 	logrus.SetLevel(logrus.InfoLevel) // Set the desired log level (e.g., DebugLevel, InfoLevel, WarnLevel, ErrorLevel)
 
-	// this is to align datetime with DB config, or the rollback sql will have +8:00 offset
-	lo, err := time.LoadLocation("")
+	if defaultSession != nil {
+		logrus.Warnf("mysqlbinlog is already started, stopping the previous session")
+		Stop()
+	}
+
+	s, err := NewSession(host, port, user, password, opts...)
 	if err != nil {
-		return fmt.Errorf("failed to load UTC timezone, err=%s", err.Error())
+		return err
 	}
+	defaultSession = s
+	return nil
+}
 
-	confCmd = &ConfCmd{
-		Host:               host,
-		Port:               port,
-		User:               user,
-		Passwd:             password,
-		BinlogTimeLocation: lo,
+// Stop stops the default session, Start() can be called again after it.
+func Stop() {
+	if defaultSession == nil {
+		logrus.Infof("no session to stop, Start() is not called")
+		return
 	}
+	defaultSession.Stop()
+	defaultSession = nil
+}
 
-	// this should happen before getTableInfo
-	if err := initMarkerDB(); err != nil {
-		return fmt.Errorf("failed to init marker db, err=%s", err.Error())
+func Rollback() error {
+	if defaultSession == nil {
+		return ErrNotStarted
 	}
+	return defaultSession.Rollback()
+}
 
-	if err := getTableInfo(); err != nil {
-		return fmt.Errorf("failed to get table info, err=%s", err.Error())
+func Begin() error {
+	if defaultSession == nil {
+		return ErrNotStarted
 	}
+	return defaultSession.Begin()
+}
 
-	pos, err := getCurrentPosition()
-	if err != nil {
-		return fmt.Errorf("failed to get binlog current position, err=%s", err.Error())
+func RollbackContext(ctx context.Context) error {
+	if defaultSession == nil {
+		return ErrNotStarted
 	}
+	return defaultSession.RollbackContext(ctx)
+}
 
-	go startListenBinEvents(pos)
-	go startGenRollbackSql()
-	return nil
+func BeginContext(ctx context.Context) error {
+	if defaultSession == nil {
+		return ErrNotStarted
+	}
+	return defaultSession.BeginContext(ctx)
 }
 
-func Stop() {
-	if sqlCon != nil {
-		// Clean up marker table
-		if err := dropMarkerDB(); err != nil {
-			logrus.Errorf("failed to drop marker db, err=%s", err.Error())
-		}
-		// Close the connection
-		logrus.Infof("closing connection to MySQL server %s:%d", confCmd.Host, confCmd.Port)
-		if err := sqlCon.Close(); err != nil {
-			logrus.Errorf("failed to close connection, err=%s", err.Error())
-		} else {
-			logrus.Infof("connection to MySQL server %s:%d closed", confCmd.Host, confCmd.Port)
-		}
-		sqlCon = nil
-	} else {
-		logrus.Infof("no connection to close, MySQL server %s:%d", confCmd.Host, confCmd.Port)
+// PreviewRollback returns the statements Rollback would execute now, see Session.PreviewRollback
+func PreviewRollback() ([]RollbackStatement, error) {
+	if defaultSession == nil {
+		return nil, ErrNotStarted
 	}
+	return defaultSession.PreviewRollback()
 }
 
-func Rollback() {
-	markerID, err := insertMarkerID()
-	if err != nil {
-		logrus.Panicf("failed to insert marker id, err=%s", err.Error())
+// CreateCheckpoint creates a named savepoint on the default session, see Session.Checkpoint
+func CreateCheckpoint(name string) (Checkpoint, error) {
+	if defaultSession == nil {
+		return Checkpoint{}, ErrNotStarted
 	}
+	return defaultSession.Checkpoint(name)
+}
 
-	// 2. Collect rollback SQL
-	sqls := rollbackSQL.collectRollbackSQL(markerID)
-
-	// 3. Execute SQLs
-	if len(sqls) > 0 {
-		sqlString := strings.Join(sqls, ";")
-		if _, err := getDBCon().Exec(sqlString); err != nil {
-			logrus.Panicf("failed to rollback sql, sql= %s err=%s", sqlString, err.Error())
-		}
-		logrus.Infof("rollback executed successfully, markerID=%d, sql count=%d", markerID, len(sqls))
-		logrus.Debugf("rollback SQLs executed: %s", sqlString)
-	} else {
-		logrus.Infof("no rollback SQLs to execute, markerID=%d", markerID)
+// RollbackTo restores a checkpoint of the default session, see Session.RollbackTo
+func RollbackTo(cp Checkpoint) error {
+	if defaultSession == nil {
+		return ErrNotStarted
 	}
+	return defaultSession.RollbackTo(cp)
 }
 
-func insertMarkerID() (int64, error) {
-	con := getMarkerDBCon()
-	// 1. Insert marker and get its id
-	res, err := con.Exec(fmt.Sprintf("INSERT INTO %s () VALUES ();", markerDatabaseTableFullName))
-	if err != nil {
-		return 0, fmt.Errorf("failed to insert marker: %s", err.Error())
+// BeginScope starts a scope on the default session, see Session.BeginScope
+func BeginScope(ctx context.Context, conns ...*sql.Conn) (*Scope, error) {
+	if defaultSession == nil {
+		return nil, ErrNotStarted
 	}
-	markerID, err := res.LastInsertId()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get marker id: %s", err.Error())
+	return defaultSession.BeginScope(ctx, conns...)
+}
+
+// LastVerifyReport returns the report of the last verified Rollback of the default session, see Session.LastVerifyReport
+func LastVerifyReport() *VerifyReport {
+	if defaultSession == nil {
+		return nil
+	}
+	return defaultSession.LastVerifyReport()
+}
+
+// Err returns the sticky error of the default session, see Session.Err
+func Err() error {
+	if defaultSession == nil {
+		return ErrNotStarted
 	}
-	return markerID, nil
+	return defaultSession.Err()
 }
 
-func Begin() {
-	rollbackSQL.begin()
+// Done returns the done channel of the default session, see Session.Done. It is nil if Start() is not called.
+func Done() <-chan struct{} {
+	if defaultSession == nil {
+		return nil
+	}
+	return defaultSession.Done()
 }
@@ -0,0 +1,327 @@
+// Command mysqlbinlog-flashback prints the SQLs reverting the changes recorded in local binlog files,
+// like the flashback mode of binlog2sql, or the original SQLs of the changes with -mode forward.
+//
+//	mysqlbinlog-flashback -host 127.0.0.1 -user root -password root \
+//	    -start-file binlog.000042 -start-pos 1234 -stop-datetime "2024-05-01 12:00:00" \
+//	    -databases shop -sql-type delete,update -output rollback.sql \
+//	    binlog.000042 binlog.000043
+//
+// The recover subcommand rolls back the changes left in the journal of a crashed test run:
+//
+//	mysqlbinlog-flashback recover -journal /tmp/mysqlbinlog.journal -password root
+//
+// The doctor subcommand checks a server is set up for the library:
+//
+//	mysqlbinlog-flashback doctor -host 127.0.0.1 -user root -password root
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
+	"github.freewheel.tv/bricks/mysqlbinlog/v2"
+)
+
+const datetimeLayout = "2006-01-02 15:04:05"
+
+type flags struct {
+	host, user, password string
+	port                 uint
+	schemaFile           string
+	saveSchema           string
+	flavor               string
+
+	startFile, stopFile         string
+	startPos, stopPos           uint
+	startDatetime, stopDatetime string
+
+	databases, tables string
+	sqlTypes          string
+	mode              string
+	output            string
+	verbose           bool
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "recover" {
+		if err := runRecover(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mysqlbinlog-flashback recover: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		if err := runDoctor(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "mysqlbinlog-flashback doctor: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	f := parseFlags()
+	if f.verbose {
+		logrus.SetLevel(logrus.InfoLevel)
+	} else {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+
+	if err := run(f, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "mysqlbinlog-flashback: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func parseFlags() *flags {
+	f := &flags{}
+	flag.StringVar(&f.host, "host", "", "MySQL host to read table schemas from")
+	flag.UintVar(&f.port, "port", 3306, "MySQL port")
+	flag.StringVar(&f.user, "user", "root", "MySQL user")
+	flag.StringVar(&f.password, "password", os.Getenv("MYSQL_PWD"), "MySQL password, MYSQL_PWD by default")
+	flag.StringVar(&f.schemaFile, "schema-file", "", "read table schemas from this snapshot instead of a server")
+	flag.StringVar(&f.saveSchema, "save-schema", "", "write the table schemas of the server to this snapshot and exit")
+	flag.StringVar(&f.flavor, "flavor", "", "mysql or mariadb, the server which wrote the binlog files, detected from the files by default")
+	flag.StringVar(&f.startFile, "start-file", "", "binlog file to start at, the first file by default")
+	flag.UintVar(&f.startPos, "start-pos", 0, "position to start at in the start file, it must be the start of a transaction")
+	flag.StringVar(&f.stopFile, "stop-file", "", "binlog file to stop at, the start file if -stop-pos is set")
+	flag.UintVar(&f.stopPos, "stop-pos", 0, "position to stop at in the stop file")
+	flag.StringVar(&f.startDatetime, "start-datetime", "", "leave out changes made before it, "+datetimeLayout+" in local time")
+	flag.StringVar(&f.stopDatetime, "stop-datetime", "", "stop at the first change made after it, "+datetimeLayout+" in local time")
+	flag.StringVar(&f.databases, "databases", "", "comma separated databases to flashback, all by default")
+	flag.StringVar(&f.tables, "tables", "", "comma separated tables to flashback, all by default")
+	flag.StringVar(&f.sqlTypes, "sql-type", "insert,update,delete", "comma separated types of changes to flashback, ddl adds schema changes")
+	flag.StringVar(&f.mode, "mode", "rollback", "rollback to print the SQLs reverting the changes, forward to print the original ones")
+	flag.StringVar(&f.output, "output", "", "write the rollback SQLs to this file instead of stdout")
+	flag.BoolVar(&f.verbose, "verbose", false, "log progress to stderr")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] binlog-file...\n\nPrints the SQLs reverting the changes recorded in local binlog files, latest change first,\nor with -mode forward the original SQLs of the changes in binlog order.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	return f
+}
+
+func run(f *flags, files []string) error {
+	if f.saveSchema != "" {
+		if f.host == "" {
+			return fmt.Errorf("-save-schema needs -host")
+		}
+		return mysqlbinlog.SaveSchemaSnapshot(f.saveSchema, f.host, f.port, f.user, f.password)
+	}
+	if len(files) == 0 {
+		flag.Usage()
+		return fmt.Errorf("no binlog file given")
+	}
+
+	opts, err := f.options(files)
+	if err != nil {
+		return err
+	}
+	filter, err := newStmtFilter(f.databases, f.tables, f.sqlTypes)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, mysqlbinlog.WithStatementFilter(filter.match))
+
+	var w io.Writer = os.Stdout
+	if f.output != "" {
+		out, err := os.Create(f.output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	return mysqlbinlog.WriteFlashback(ctx, w, files, opts...)
+}
+
+func runRecover(args []string) error {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	journalPath := fs.String("journal", "", "journal written by a session started with WithJournal")
+	password := fs.String("password", os.Getenv("MYSQL_PWD"), "password of the user recorded in the journal, MYSQL_PWD by default")
+	verbose := fs.Bool("verbose", false, "log progress to stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s recover -journal path [flags]\n\nRolls back the changes left in the journal of a crashed run, then removes the journal.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *verbose {
+		logrus.SetLevel(logrus.InfoLevel)
+	} else {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+	if *journalPath == "" {
+		fs.Usage()
+		return fmt.Errorf("no journal given")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	return mysqlbinlog.RecoverAndRollbackContext(ctx, *journalPath, *password)
+}
+
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	host := fs.String("host", "127.0.0.1", "MySQL host")
+	port := fs.Uint("port", 3306, "MySQL port")
+	user := fs.String("user", "root", "MySQL user")
+	password := fs.String("password", os.Getenv("MYSQL_PWD"), "MySQL password, MYSQL_PWD by default")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s doctor [flags]\n\nChecks the binlog settings and the privileges the library relies on.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	report, err := mysqlbinlog.Preflight(*host, *port, *user, *password)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("server %s:%d, version %s\n", *host, *port, report.Version)
+	for _, c := range report.Checks {
+		switch {
+		case c.Passed:
+			fmt.Printf("  [ OK ] %s\n", c.Name)
+		case c.Warning:
+			fmt.Printf("  [WARN] %s: %s\n", c.Name, c.Message)
+		default:
+			fmt.Printf("  [FAIL] %s: %s\n", c.Name, c.Message)
+		}
+	}
+	if failed := report.Failed(); len(failed) > 0 {
+		return fmt.Errorf("%d check(s) failed", len(failed))
+	}
+	return nil
+}
+
+func (f *flags) options(files []string) ([]mysqlbinlog.Option, error) {
+	var opts []mysqlbinlog.Option
+	switch f.mode {
+	case "rollback":
+	case "forward":
+		opts = append(opts, mysqlbinlog.WithGenMode(mysqlbinlog.GenModeForward))
+	default:
+		return nil, fmt.Errorf("invalid -mode %s, it should be rollback or forward", f.mode)
+	}
+
+	switch f.flavor {
+	case "":
+	case mysql.MySQLFlavor, mysql.MariaDBFlavor:
+		opts = append(opts, mysqlbinlog.WithFlavor(f.flavor))
+	default:
+		return nil, fmt.Errorf("invalid -flavor %s, it should be mysql or mariadb", f.flavor)
+	}
+
+	if splitSet(strings.ToLower(f.sqlTypes))["ddl"] {
+		// without a server to snapshot, only DDL like CREATE TABLE or ADD COLUMN is reverted
+		opts = append(opts, mysqlbinlog.WithDDLRollback())
+	}
+
+	switch {
+	case f.schemaFile != "":
+		opts = append(opts, mysqlbinlog.WithSchemaFile(f.schemaFile))
+	case f.host != "":
+		opts = append(opts, mysqlbinlog.WithSchemaFrom(f.host, f.port, f.user, f.password))
+	default:
+		return nil, fmt.Errorf("table schemas are needed, give -host or -schema-file")
+	}
+
+	startFile := f.startFile
+	if startFile == "" {
+		startFile = filepath.Base(files[0])
+	}
+	if f.startFile != "" || f.startPos > 0 {
+		opts = append(opts, mysqlbinlog.WithStartPosition(mysql.Position{Name: startFile, Pos: uint32(f.startPos)}))
+	}
+	if f.stopFile != "" || f.stopPos > 0 {
+		stopFile := f.stopFile
+		if stopFile == "" {
+			stopFile = startFile
+		}
+		stopPos := uint32(f.stopPos)
+		if f.stopPos == 0 {
+			// the whole stop file
+			stopPos = ^uint32(0)
+		}
+		opts = append(opts, mysqlbinlog.WithStopPosition(mysql.Position{Name: stopFile, Pos: stopPos}))
+	}
+
+	if f.startDatetime != "" {
+		t, err := time.ParseInLocation(datetimeLayout, f.startDatetime, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -start-datetime %s, err=%s", f.startDatetime, err.Error())
+		}
+		opts = append(opts, mysqlbinlog.WithStartDatetime(t))
+	}
+	if f.stopDatetime != "" {
+		t, err := time.ParseInLocation(datetimeLayout, f.stopDatetime, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -stop-datetime %s, err=%s", f.stopDatetime, err.Error())
+		}
+		opts = append(opts, mysqlbinlog.WithStopDatetime(t))
+	}
+	return opts, nil
+}
+
+// stmtFilter keeps the statements of the selected databases, tables and change types
+type stmtFilter struct {
+	databases map[string]bool
+	tables    map[string]bool
+	sqlTypes  map[mysqlbinlog.SQLType]bool
+}
+
+func newStmtFilter(databases, tables, sqlTypes string) (*stmtFilter, error) {
+	f := &stmtFilter{databases: splitSet(databases), tables: splitSet(tables), sqlTypes: map[mysqlbinlog.SQLType]bool{}}
+	for name := range splitSet(sqlTypes) {
+		switch strings.ToLower(name) {
+		case "insert":
+			f.sqlTypes[mysqlbinlog.SQLTypeInsert] = true
+		case "update":
+			f.sqlTypes[mysqlbinlog.SQLTypeUpdate] = true
+		case "delete":
+			f.sqlTypes[mysqlbinlog.SQLTypeDelete] = true
+		case "ddl":
+			f.sqlTypes[mysqlbinlog.SQLTypeDDL] = true
+		default:
+			return nil, fmt.Errorf("invalid -sql-type %s, it should be insert, update, delete or ddl", name)
+		}
+	}
+	return f, nil
+}
+
+func (f *stmtFilter) match(stmt mysqlbinlog.RollbackStatement) bool {
+	if len(f.databases) > 0 && !f.databases[stmt.DB] {
+		return false
+	}
+	// tables can be given as table or db.table
+	if len(f.tables) > 0 && !f.tables[stmt.Table] && !f.tables[stmt.DB+"."+stmt.Table] {
+		return false
+	}
+	return len(f.sqlTypes) == 0 || f.sqlTypes[stmt.Type]
+}
+
+func splitSet(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
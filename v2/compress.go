@@ -0,0 +1,236 @@
+package mysqlbinlog
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// MariaDB events compressed by log_bin_compress, the binlog library can not decode them.
+// The tracker inflates them into the events they compress and decodes those with a parser of its own.
+const (
+	mariadbQueryCompressedEvent replication.EventType = 165 + iota
+	mariadbWriteRowsCompressedEventV1
+	mariadbUpdateRowsCompressedEventV1
+	mariadbDeleteRowsCompressedEventV1
+	mariadbWriteRowsCompressedEvent
+	mariadbUpdateRowsCompressedEvent
+	mariadbDeleteRowsCompressedEvent
+)
+
+const (
+	queryPostHeaderLen  = 13 // QUERY_EVENT post header, up to the status vars
+	rowsPostHeaderLenV1 = 8
+	rowsPostHeaderLenV2 = 10 // with the length of the extra data
+)
+
+// uncompressEvent returns ev with its compressed part inflated, ev itself if it is not compressed.
+// The format description and table map events are fed to the parser, it needs them for the rows events.
+func (t *eventTracker) uncompressEvent(ev *replication.BinlogEvent) (*replication.BinlogEvent, error) {
+	switch ev.Header.EventType {
+	case replication.FORMAT_DESCRIPTION_EVENT, replication.TABLE_MAP_EVENT:
+		if ev.Header.EventType == replication.FORMAT_DESCRIPTION_EVENT {
+			t.format = ev.Event.(*replication.FormatDescriptionEvent)
+		}
+		if _, err := t.inflateParser().Parse(ev.RawData); err != nil {
+			return nil, fmt.Errorf("failed to parse event %s at %s %d, err=%s", ev.Header.EventType, t.currentBinlog, ev.Header.LogPos, err.Error())
+		}
+		return ev, nil
+	case mariadbQueryCompressedEvent,
+		mariadbWriteRowsCompressedEventV1, mariadbUpdateRowsCompressedEventV1, mariadbDeleteRowsCompressedEventV1,
+		mariadbWriteRowsCompressedEvent, mariadbUpdateRowsCompressedEvent, mariadbDeleteRowsCompressedEvent:
+	default:
+		return ev, nil
+	}
+
+	if t.format == nil {
+		return nil, fmt.Errorf("compressed event %d at %s %d comes before any format description event", ev.Header.EventType, t.currentBinlog, ev.Header.LogPos)
+	}
+	raw, err := inflateEvent(t.format, ev.RawData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to uncompress event %d at %s %d, err=%s", ev.Header.EventType, t.currentBinlog, ev.Header.LogPos, err.Error())
+	}
+	uncompressed, err := t.inflateParser().Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse uncompressed event %d at %s %d, err=%s", ev.Header.EventType, t.currentBinlog, ev.Header.LogPos, err.Error())
+	}
+	return uncompressed, nil
+}
+
+// inflateParser returns the parser of the uncompressed events, set up like the one of the binlog stream
+func (t *eventTracker) inflateParser() *replication.BinlogParser {
+	if t.parser == nil {
+		t.parser = replication.NewBinlogParser()
+		t.parser.SetFlavor(t.session.conf.Flavor)
+		t.parser.SetTimestampStringLocation(t.session.conf.BinlogTimeLocation)
+		t.parser.SetParseTime(false)
+		t.parser.SetUseDecimal(true)
+	}
+	return t.parser
+}
+
+// inflateEvent returns the raw data of the event which the compressed event raw stands for,
+// with the same header but the event type, the size and the checksum
+func inflateEvent(format *replication.FormatDescriptionEvent, raw []byte) ([]byte, error) {
+	if len(raw) < replication.EventHeaderSize {
+		return nil, fmt.Errorf("event of %d bytes is shorter than its header", len(raw))
+	}
+	eventType := replication.EventType(raw[4])
+	body := raw[replication.EventHeaderSize:]
+	checksum := format.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32
+	if checksum {
+		if len(body) < replication.BinlogChecksumLength {
+			return nil, fmt.Errorf("event of %d bytes is shorter than its checksum", len(raw))
+		}
+		body = body[:len(body)-replication.BinlogChecksumLength]
+	}
+
+	var prefix int
+	var uncompressedType replication.EventType
+	var err error
+	if eventType == mariadbQueryCompressedEvent {
+		uncompressedType = replication.QUERY_EVENT
+		prefix, err = queryPrefixLen(body)
+	} else {
+		uncompressedType, prefix, err = rowsPrefixLen(body, eventType, postHeaderLen(format, eventType))
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := mariadbUncompress(body[prefix:])
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, replication.EventHeaderSize+prefix+len(data)+replication.BinlogChecksumLength)
+	out = append(out, raw[:replication.EventHeaderSize]...)
+	out = append(out, body[:prefix]...)
+	out = append(out, data...)
+	out[4] = byte(uncompressedType)
+	size := len(out)
+	if checksum {
+		size += replication.BinlogChecksumLength
+	}
+	binary.LittleEndian.PutUint32(out[9:], uint32(size))
+	if checksum {
+		sum := make([]byte, replication.BinlogChecksumLength)
+		binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(out))
+		out = append(out, sum...)
+	}
+	return out, nil
+}
+
+// postHeaderLen returns the post header length of eventType told by the format description event
+func postHeaderLen(format *replication.FormatDescriptionEvent, eventType replication.EventType) int {
+	if i := int(eventType) - 1; i < len(format.EventTypeHeaderLengths) {
+		return int(format.EventTypeHeaderLengths[i])
+	}
+	if eventType >= mariadbWriteRowsCompressedEvent {
+		return rowsPostHeaderLenV2
+	}
+	return rowsPostHeaderLenV1
+}
+
+// queryPrefixLen returns the length of the uncompressed part of a compressed query event body,
+// everything up to the query
+func queryPrefixLen(body []byte) (int, error) {
+	if len(body) < queryPostHeaderLen {
+		return 0, fmt.Errorf("query event body of %d bytes is shorter than its post header", len(body))
+	}
+	schemaLen := int(body[8])
+	statusVarsLen := int(binary.LittleEndian.Uint16(body[11:]))
+	// the schema ends with a 0x00
+	prefix := queryPostHeaderLen + statusVarsLen + schemaLen + 1
+	if prefix > len(body) {
+		return 0, fmt.Errorf("query event body of %d bytes is shorter than its status vars and schema", len(body))
+	}
+	return prefix, nil
+}
+
+// rowsPrefixLen returns the type of the uncompressed rows event and the length of the uncompressed part
+// of a compressed rows event body, everything up to the rows: the table id, the flags, the extra data,
+// the column count and the column bitmaps
+func rowsPrefixLen(body []byte, eventType replication.EventType, headerLen int) (replication.EventType, int, error) {
+	uncompressedTypes := [][]replication.EventType{
+		{replication.WRITE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv1},
+		{replication.WRITE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv2, replication.DELETE_ROWS_EVENTv2},
+	}
+	version := 0
+	if headerLen == rowsPostHeaderLenV2 {
+		version = 1
+	}
+	op := int(eventType-mariadbWriteRowsCompressedEventV1) % 3
+	uncompressedType := uncompressedTypes[version][op]
+
+	tableIDSize := 6
+	if headerLen == 6 {
+		tableIDSize = 4
+	}
+	pos := tableIDSize + 2
+	if version == 1 {
+		if len(body) < pos+2 {
+			return 0, 0, fmt.Errorf("rows event body of %d bytes is shorter than its post header", len(body))
+		}
+		// the length counts itself
+		extraLen := int(binary.LittleEndian.Uint16(body[pos:]))
+		if extraLen < 2 {
+			return 0, 0, fmt.Errorf("invalid extra data length %d of rows event", extraLen)
+		}
+		pos += extraLen
+	}
+	if pos >= len(body) {
+		return 0, 0, fmt.Errorf("rows event body of %d bytes has no column count", len(body))
+	}
+	columnCount, _, n := mysql.LengthEncodedInt(body[pos:])
+	pos += n
+	bitmapLen := int((columnCount + 7) / 8)
+	pos += bitmapLen
+	if op == 1 {
+		// the columns of the after image
+		pos += bitmapLen
+	}
+	if pos > len(body) {
+		return 0, 0, fmt.Errorf("rows event body of %d bytes is shorter than its column bitmaps", len(body))
+	}
+	return uncompressedType, pos, nil
+}
+
+// mariadbUncompress inflates data compressed by binlog_buf_compress of MariaDB: a header byte with 0x80 set,
+// the algorithm in bits 4-6, zlib only, and the size of the length in bits 0-2, then the uncompressed length
+// big endian, then the zlib stream
+func mariadbUncompress(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0]&0x80 == 0 {
+		return nil, fmt.Errorf("no compression header")
+	}
+	if alg := (data[0] & 0x70) >> 4; alg != 0 {
+		return nil, fmt.Errorf("unknown compression algorithm %d", alg)
+	}
+	lenLen := int(data[0] & 0x07)
+	if lenLen < 1 || lenLen > 4 || len(data) < 1+lenLen {
+		return nil, fmt.Errorf("invalid uncompressed length of %d bytes", lenLen)
+	}
+	var size uint32
+	for _, b := range data[1 : 1+lenLen] {
+		size = size<<8 | uint32(b)
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(data[1+lenLen:]))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != int(size) {
+		return nil, fmt.Errorf("uncompressed %d bytes, the header says %d", len(out), size)
+	}
+	return out, nil
+}
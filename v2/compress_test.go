@@ -0,0 +1,236 @@
+package mysqlbinlog
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+const testTableID = 42
+
+// mariadbCompress compresses data like binlog_buf_compress of MariaDB
+func mariadbCompress(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var size []byte
+	for n := uint32(len(data)); n > 0 || len(size) == 0; n >>= 8 {
+		size = append([]byte{byte(n)}, size...)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | byte(len(size)))
+	buf.Write(size)
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// rawEvent returns the header, body and CRC32 checksum of an event
+func rawEvent(eventType replication.EventType, logPos uint32, body []byte) []byte {
+	raw := make([]byte, replication.EventHeaderSize, replication.EventHeaderSize+len(body)+replication.BinlogChecksumLength)
+	raw[4] = byte(eventType)
+	binary.LittleEndian.PutUint32(raw[5:], 1)
+	binary.LittleEndian.PutUint32(raw[9:], uint32(replication.EventHeaderSize+len(body)+replication.BinlogChecksumLength))
+	binary.LittleEndian.PutUint32(raw[13:], logPos)
+	raw = append(raw, body...)
+	sum := make([]byte, replication.BinlogChecksumLength)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(raw))
+	return append(raw, sum...)
+}
+
+func formatDescriptionBody() []byte {
+	body := []byte{4, 0}
+	version := make([]byte, 50)
+	copy(version, "10.6.12-MariaDB-log")
+	body = append(body, version...)
+	body = append(body, 0, 0, 0, 0, replication.EventHeaderSize)
+	lengths := make([]byte, int(mariadbDeleteRowsCompressedEvent))
+	lengths[replication.QUERY_EVENT-1] = queryPostHeaderLen
+	lengths[replication.TABLE_MAP_EVENT-1] = 8
+	for _, et := range []replication.EventType{replication.WRITE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv1,
+		mariadbWriteRowsCompressedEventV1, mariadbUpdateRowsCompressedEventV1, mariadbDeleteRowsCompressedEventV1} {
+		lengths[et-1] = rowsPostHeaderLenV1
+	}
+	for _, et := range []replication.EventType{replication.WRITE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv2, replication.DELETE_ROWS_EVENTv2,
+		mariadbWriteRowsCompressedEvent, mariadbUpdateRowsCompressedEvent, mariadbDeleteRowsCompressedEvent} {
+		lengths[et-1] = rowsPostHeaderLenV2
+	}
+	lengths[mariadbQueryCompressedEvent-1] = queryPostHeaderLen
+	body = append(body, lengths...)
+	return append(body, replication.BINLOG_CHECKSUM_ALG_CRC32)
+}
+
+// tableMapBody maps shop.orders (id INT, name VARCHAR(255) NULL)
+func tableMapBody() []byte {
+	body := make([]byte, 6, 64)
+	binary.LittleEndian.PutUint32(body, testTableID)
+	body = append(body, 0, 0)
+	body = append(body, 4)
+	body = append(body, "shop"...)
+	body = append(body, 0, 6)
+	body = append(body, "orders"...)
+	body = append(body, 0)
+	body = append(body, 2, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR)
+	body = append(body, 2, 0xff, 0x00) // max length of the VARCHAR
+	return append(body, 0x02)          // name is nullable
+}
+
+// rowImage encodes (id, name) with both columns present
+func rowImage(id int32, name string) []byte {
+	row := make([]byte, 5, 16)
+	binary.LittleEndian.PutUint32(row[1:], uint32(id))
+	row = append(row, byte(len(name)))
+	return append(row, name...)
+}
+
+// rowsBody returns the body of a compressed rows event of shop.orders, with the extra data of v2 if v2 is set
+func rowsBody(t *testing.T, v2, update bool, rows ...[]byte) []byte {
+	body := make([]byte, 6, 64)
+	binary.LittleEndian.PutUint32(body, testTableID)
+	body = append(body, 0x01, 0x00) // end of statement
+	if v2 {
+		body = append(body, 2, 0)
+	}
+	body = append(body, 2, 0x03)
+	if update {
+		body = append(body, 0x03)
+	}
+	return append(body, mariadbCompress(t, bytes.Join(rows, nil))...)
+}
+
+func compressTracker() *eventTracker {
+	return &eventTracker{
+		session:       &Session{conf: &ConfCmd{Flavor: mysql.MariaDBFlavor, BinlogTimeLocation: time.UTC}},
+		currentBinlog: "mysql-bin.000001",
+	}
+}
+
+// feed parses raw like the binlog stream does and returns the event the tracker makes of it
+func feed(t *testing.T, tracker *eventTracker, stream *replication.BinlogParser, raw []byte) *replication.BinlogEvent {
+	t.Helper()
+	ev, err := stream.Parse(raw)
+	if err != nil {
+		t.Fatalf("stream parse: %s", err)
+	}
+	ev, err = tracker.uncompressEvent(ev)
+	if err != nil {
+		t.Fatalf("uncompressEvent: %s", err)
+	}
+	return ev
+}
+
+func TestUncompressRowsEvents(t *testing.T) {
+	cases := []struct {
+		name      string
+		eventType replication.EventType
+		v2        bool
+		rows      [][]byte
+		wantType  replication.EventType
+		wantRows  [][]interface{}
+	}{
+		{"write v1", mariadbWriteRowsCompressedEventV1, false, [][]byte{rowImage(1, "a"), rowImage(2, "bc")},
+			replication.WRITE_ROWS_EVENTv1, [][]interface{}{{int32(1), "a"}, {int32(2), "bc"}}},
+		{"update v1", mariadbUpdateRowsCompressedEventV1, false, [][]byte{rowImage(1, "a"), rowImage(1, "b")},
+			replication.UPDATE_ROWS_EVENTv1, [][]interface{}{{int32(1), "a"}, {int32(1), "b"}}},
+		{"delete v1", mariadbDeleteRowsCompressedEventV1, false, [][]byte{rowImage(3, "")},
+			replication.DELETE_ROWS_EVENTv1, [][]interface{}{{int32(3), ""}}},
+		{"write v2", mariadbWriteRowsCompressedEvent, true, [][]byte{rowImage(-1, "x")},
+			replication.WRITE_ROWS_EVENTv2, [][]interface{}{{int32(-1), "x"}}},
+		{"update v2", mariadbUpdateRowsCompressedEvent, true, [][]byte{rowImage(5, "old"), rowImage(5, "new")},
+			replication.UPDATE_ROWS_EVENTv2, [][]interface{}{{int32(5), "old"}, {int32(5), "new"}}},
+		{"delete v2", mariadbDeleteRowsCompressedEvent, true, [][]byte{rowImage(7, "z")},
+			replication.DELETE_ROWS_EVENTv2, [][]interface{}{{int32(7), "z"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tracker := compressTracker()
+			stream := replication.NewBinlogParser()
+			feed(t, tracker, stream, rawEvent(replication.FORMAT_DESCRIPTION_EVENT, 0, formatDescriptionBody()))
+			feed(t, tracker, stream, rawEvent(replication.TABLE_MAP_EVENT, 200, tableMapBody()))
+			update := c.eventType == mariadbUpdateRowsCompressedEventV1 || c.eventType == mariadbUpdateRowsCompressedEvent
+			ev := feed(t, tracker, stream, rawEvent(c.eventType, 300, rowsBody(t, c.v2, update, c.rows...)))
+
+			if ev.Header.EventType != c.wantType || ev.Header.LogPos != 300 {
+				t.Fatalf("event type %s at %d, want %s at 300", ev.Header.EventType, ev.Header.LogPos, c.wantType)
+			}
+			rowsEv, ok := ev.Event.(*replication.RowsEvent)
+			if !ok {
+				t.Fatalf("event %T, want *replication.RowsEvent", ev.Event)
+			}
+			if string(rowsEv.Table.Schema) != "shop" || string(rowsEv.Table.Table) != "orders" {
+				t.Errorf("table %s.%s, want shop.orders", rowsEv.Table.Schema, rowsEv.Table.Table)
+			}
+			if !reflect.DeepEqual(rowsEv.Rows, c.wantRows) {
+				t.Errorf("rows %v, want %v", rowsEv.Rows, c.wantRows)
+			}
+		})
+	}
+}
+
+func TestUncompressQueryEvent(t *testing.T) {
+	tracker := compressTracker()
+	stream := replication.NewBinlogParser()
+	feed(t, tracker, stream, rawEvent(replication.FORMAT_DESCRIPTION_EVENT, 0, formatDescriptionBody()))
+
+	query := "ALTER TABLE orders ADD COLUMN note VARCHAR(64)"
+	body := []byte{7, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0}
+	body = append(body, "shop"...)
+	body = append(body, 0)
+	body = append(body, mariadbCompress(t, []byte(query))...)
+	ev := feed(t, tracker, stream, rawEvent(mariadbQueryCompressedEvent, 500, body))
+
+	if ev.Header.EventType != replication.QUERY_EVENT {
+		t.Fatalf("event type %s, want QueryEvent", ev.Header.EventType)
+	}
+	queryEv := ev.Event.(*replication.QueryEvent)
+	if string(queryEv.Query) != query || string(queryEv.Schema) != "shop" || queryEv.SlaveProxyID != 7 {
+		t.Errorf("query %q on %q by %d, want %q on shop by 7", queryEv.Query, queryEv.Schema, queryEv.SlaveProxyID, query)
+	}
+}
+
+func TestUncompressNeedsFormatDescription(t *testing.T) {
+	tracker := compressTracker()
+	ev := &replication.BinlogEvent{
+		Header:  &replication.EventHeader{EventType: mariadbWriteRowsCompressedEventV1, LogPos: 300},
+		RawData: rawEvent(mariadbWriteRowsCompressedEventV1, 300, rowsBody(t, false, false, rowImage(1, "a"))),
+	}
+	if _, err := tracker.uncompressEvent(ev); err == nil {
+		t.Error("uncompressEvent without a format description event succeeded, want an error")
+	}
+}
+
+func TestMariadbUncompress(t *testing.T) {
+	data := bytes.Repeat([]byte("rows "), 100)
+	got, err := mariadbUncompress(mariadbCompress(t, data))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("mariadbUncompress = %q, %v, want %q", got, err, data)
+	}
+
+	valid := mariadbCompress(t, data)
+	wrongLen := append([]byte{}, valid...)
+	wrongLen[2]++
+	badAlg := append([]byte{}, valid...)
+	badAlg[0] |= 0x10
+	for name, in := range map[string][]byte{
+		"empty":           nil,
+		"no header":       valid[1:],
+		"zero length":     {0x80},
+		"algorithm":       badAlg,
+		"length mismatch": wrongLen,
+		"truncated":       valid[:len(valid)-4],
+	} {
+		if _, err := mariadbUncompress(in); err == nil {
+			t.Errorf("%s: mariadbUncompress succeeded, want an error", name)
+		}
+	}
+}
@@ -2,11 +2,23 @@ package mysqlbinlog
 
 import (
 	"fmt"
+	"math/rand"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
 	_ "github.com/pingcap/tidb/types/parser_driver"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+const (
+	defaultServerID = 1113306
+	defaultCharset  = "utf8"
+
+	defaultMaxReconnectAttempts = 10
+	defaultReconnectMinBackoff  = 500 * time.Millisecond
+	defaultReconnectMaxBackoff  = 30 * time.Second
 )
 
 type ConfCmd struct {
@@ -16,9 +28,260 @@ type ConfCmd struct {
 	Passwd             string
 	StartFile          string
 	BinlogTimeLocation *time.Location
+
+	// replication settings, see replication.BinlogSyncerConfig
+	ServerID        uint32
+	Flavor          string
+	Charset         string
+	HeartbeatPeriod time.Duration
+	ReadTimeout     time.Duration
+
+	// reconnect of a broken binlog stream, MaxReconnectAttempts 0 disables it
+	MaxReconnectAttempts int
+	ReconnectMinBackoff  time.Duration
+	ReconnectMaxBackoff  time.Duration
+	OnReconnect          func(ReconnectInfo)
+
+	JournalPath string // record rollback entries on disk for RecoverAndRollback
+
+	Verify       bool     // checksum tables at Begin and compare them after Rollback
+	VerifyTables []string // db.table checksummed besides the tracked tables
+	GTID         bool     // sync binlog from the executed GTID set instead of file/position
+	DDLRollback  bool     // revert schema changes too, see WithDDLRollback
+	DDLTables    []string // db or db.table whose definitions are read at Start
+
+	Shadow       bool     // restore truncated and dropped tables from shadow snapshots, see WithShadowSnapshots
+	ShadowTables []string // db.table snapshotted from the first Begin on
+
+	SchemaFile string                       // load table schemas from a snapshot file instead of the server
+	GenMode    GenMode                      // statements to generate, Flashback only
+	Filter     func(RollbackStatement) bool // statements to keep, Flashback only
+
+	// range of the offline flashback, zero values are unbounded
+	StartPos  mysql.Position
+	StopPos   mysql.Position
+	StartTime time.Time
+	StopTime  time.Time
+}
+
+// Option customizes a session created by Start or NewSession
+type Option func(*ConfCmd)
+
+// WithServerID sets the server ID the session registers as replica with, it must be unique among
+// all replicas of the MySQL server, or MySQL kicks off the other connection using the same ID.
+func WithServerID(id uint32) Option {
+	return func(c *ConfCmd) {
+		c.ServerID = id
+	}
+}
+
+// WithRandomServerID picks a random server ID, so that several processes can listen the same MySQL server.
+func WithRandomServerID() Option {
+	return func(c *ConfCmd) {
+		c.ServerID = randomServerID()
+	}
 }
 
-var confCmd *ConfCmd
+// WithFlavor sets the server flavor, mysql.MySQLFlavor or mysql.MariaDBFlavor.
+// The flavor is detected from the server version if it is not set.
+func WithFlavor(flavor string) Option {
+	return func(c *ConfCmd) {
+		c.Flavor = flavor
+	}
+}
+
+// WithCharset sets the charset of the replication connection.
+func WithCharset(charset string) Option {
+	return func(c *ConfCmd) {
+		c.Charset = charset
+	}
+}
+
+// WithHeartbeatPeriod asks the MySQL server to send heartbeat events when the binlog is idle.
+func WithHeartbeatPeriod(d time.Duration) Option {
+	return func(c *ConfCmd) {
+		c.HeartbeatPeriod = d
+	}
+}
+
+// WithReadTimeout sets the read timeout of the replication connection,
+// it should be longer than the heartbeat period if both are set.
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *ConfCmd) {
+		c.ReadTimeout = d
+	}
+}
+
+// WithBinlogTimeLocation sets the time zone TIMESTAMP values are formatted in, it is UTC by default.
+func WithBinlogTimeLocation(loc *time.Location) Option {
+	return func(c *ConfCmd) {
+		c.BinlogTimeLocation = loc
+	}
+}
+
+// WithGTID syncs the binlog from the executed GTID set of the server instead of its file/position,
+// which survives failovers and purged binlogs. The server must run with gtid_mode=ON.
+func WithGTID() Option {
+	return func(c *ConfCmd) {
+		c.GTID = true
+	}
+}
+
+// WithSchemaFile makes Flashback load table schemas from a snapshot written by SaveSchemaSnapshot instead of a server.
+// Tables created after the snapshot are unknown and their changes are skipped. Live sessions do not support it.
+func WithSchemaFile(path string) Option {
+	return func(c *ConfCmd) {
+		c.SchemaFile = path
+	}
+}
+
+// WithSchemaFrom makes Flashback load table schemas from a live server.
+func WithSchemaFrom(host string, port uint, user string, password string) Option {
+	return func(c *ConfCmd) {
+		c.Host = host
+		c.Port = port
+		c.User = user
+		c.Passwd = password
+	}
+}
+
+// WithStartPosition makes Flashback start at pos, which should be the start of a transaction.
+func WithStartPosition(pos mysql.Position) Option {
+	return func(c *ConfCmd) {
+		c.StartPos = pos
+	}
+}
+
+// WithStopPosition makes Flashback stop at pos, changes ending after it are left out.
+func WithStopPosition(pos mysql.Position) Option {
+	return func(c *ConfCmd) {
+		c.StopPos = pos
+	}
+}
+
+// WithStartDatetime makes Flashback leave out the changes made before t.
+func WithStartDatetime(t time.Time) Option {
+	return func(c *ConfCmd) {
+		c.StartTime = t
+	}
+}
+
+// WithStopDatetime makes Flashback stop at the first change made after t.
+func WithStopDatetime(t time.Time) Option {
+	return func(c *ConfCmd) {
+		c.StopTime = t
+	}
+}
+
+// WithGenMode makes Flashback generate the original statements with GenModeForward instead of
+// the rollback ones. Live sessions only support GenModeRollback.
+func WithGenMode(mode GenMode) Option {
+	return func(c *ConfCmd) {
+		c.GenMode = mode
+	}
+}
+
+// WithStatementFilter makes Flashback keep only the statements keep returns true for.
+func WithStatementFilter(keep func(RollbackStatement) bool) Option {
+	return func(c *ConfCmd) {
+		c.Filter = keep
+	}
+}
+
+// ReconnectInfo describes a reconnect attempt of a broken binlog stream
+type ReconnectInfo struct {
+	Attempt int
+	Pos     mysql.Position // where the stream resumes from, the end of the last committed transaction
+	GTIDSet string         // GTIDs committed so far, the stream resumes after them in GTID mode
+	Err     error          // why the stream broke, or why the last attempt failed
+}
+
+// WithReconnect sets how a broken binlog stream is resumed, after a server restart or a network blip.
+// It retries up to maxAttempts times, waiting from minBackoff up to maxBackoff, doubling each time.
+// maxAttempts 0 disables reconnecting, the session then fails on the first broken stream.
+func WithReconnect(maxAttempts int, minBackoff, maxBackoff time.Duration) Option {
+	return func(c *ConfCmd) {
+		c.MaxReconnectAttempts = maxAttempts
+		c.ReconnectMinBackoff = minBackoff
+		c.ReconnectMaxBackoff = maxBackoff
+	}
+}
+
+// WithReconnectCallback calls fn before each reconnect attempt, e.g. to count them in a metric.
+func WithReconnectCallback(fn func(ReconnectInfo)) Option {
+	return func(c *ConfCmd) {
+		c.OnReconnect = fn
+	}
+}
+
+// WithJournal records the rollback entries in a journal at path, so that RecoverAndRollback can undo
+// the changes of a process which crashes before Rollback. The journal is removed by Stop if nothing is
+// left to roll back, and a session refuses to start over a journal which is not recovered yet.
+func WithJournal(path string) Option {
+	return func(c *ConfCmd) {
+		c.JournalPath = path
+	}
+}
+
+// WithVerify checksums the tables at Begin, and checks after Rollback that the tables
+// it touched are back to that state, see VerifyReport. The tracked tables, those touched by earlier
+// cycles and tables given as db.table are checksummed. RollbackTo and scopes are not verified.
+func WithVerify(tables ...string) Option {
+	return func(c *ConfCmd) {
+		c.Verify = true
+		c.VerifyTables = append(c.VerifyTables, tables...)
+	}
+}
+
+// WithDDLRollback reverts the schema changes made in the binlog too, e.g. drops the tables created
+// and re-creates the dropped ones. The SHOW CREATE TABLE of a table is read when the binlog shows it first,
+// tables, as db or db.table, are read at Start, for DDL dropping or altering tables not changed before.
+// DDL which can not be reverted is reported by an *IrreversibleDDLError from Rollback.
+func WithDDLRollback(tables ...string) Option {
+	return func(c *ConfCmd) {
+		c.DDLRollback = true
+		c.DDLTables = append(c.DDLTables, tables...)
+	}
+}
+
+// WithShadowSnapshots keeps a copy of the tables touched by the test cases in a shadow schema, so that
+// Rollback restores the rows removed by TRUNCATE TABLE or DROP TABLE, which are not in the binlog.
+// A table is copied by the first Begin after a cycle touched it, tables given as db.table are copied
+// from the first Begin on.
+func WithShadowSnapshots(tables ...string) Option {
+	return func(c *ConfCmd) {
+		c.Shadow = true
+		c.ShadowTables = append(c.ShadowTables, tables...)
+	}
+}
+
+func newConfCmd(host string, port uint, user string, password string, opts ...Option) *ConfCmd {
+	c := &ConfCmd{
+		Host:                 host,
+		Port:                 port,
+		User:                 user,
+		Passwd:               password,
+		ServerID:             defaultServerID,
+		Charset:              defaultCharset,
+		MaxReconnectAttempts: defaultMaxReconnectAttempts,
+		ReconnectMinBackoff:  defaultReconnectMinBackoff,
+		ReconnectMaxBackoff:  defaultReconnectMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+var serverIDRand = rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())))
+var serverIDRandMu sync.Mutex
+
+// randomServerID returns an ID far away from the small IDs usually given to real replicas
+func randomServerID() uint32 {
+	serverIDRandMu.Lock()
+	defer serverIDRandMu.Unlock()
+	return uint32(serverIDRand.Int63n(1<<31-1<<24)) + 1<<24
+}
 
 var skipTables sync.Map
 
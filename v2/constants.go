@@ -11,9 +11,14 @@ const (
 )
 
 const (
-	disableBinlogSQL    = "SET sql_log_bin = OFF;"
-	disableKeyCheckSQL  = "SET FOREIGN_KEY_CHECKS=0;"
-	showMasterStatusSQL = "SHOW MASTER STATUS;"
+	disableBinlogSQL       = "SET sql_log_bin = OFF;"
+	disableKeyCheckSQL     = "SET FOREIGN_KEY_CHECKS=0;"
+	showMasterStatusSQL    = "SHOW MASTER STATUS;"
+	showBinaryLogStatusSQL = "SHOW BINARY LOG STATUS;" // replaces SHOW MASTER STATUS since MySQL 8.2, which is removed in 8.4
+	versionSQL             = "SELECT VERSION();"
+	mariadbGTIDPosSQL      = "SELECT @@GLOBAL.gtid_current_pos;"
+	serverSettingsSQL      = "SHOW GLOBAL VARIABLES WHERE Variable_name IN ('log_bin', 'binlog_format', 'binlog_row_image', 'binlog_transaction_compression');"
+	authPluginSQL          = "SELECT plugin FROM mysql.user WHERE CONCAT(user, '@', host) = CURRENT_USER();"
 )
 
 const (
@@ -31,12 +36,12 @@ const (
 		order by table_schema asc, table_name asc, ORDINAL_POSITION asc
 	`
 
+	shadowColumnsSQL = "SELECT COLUMN_NAME FROM information_schema.columns WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND EXTRA NOT LIKE '%GENERATED%' ORDER BY ORDINAL_POSITION"
+
 	autoIncrementsSQL   = "SELECT `TABLE_SCHEMA`, `TABLE_NAME`, `AUTO_INCREMENT` FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = '%s' AND TABLE_NAME IN (%s)"
 	setAutoIncrementSQL = "ALTER TABLE %s.%s AUTO_INCREMENT=%d"
 )
 
-var tableinfo tablesColumnsInfo
-
 const getTableNamesSQL = "SELECT table_schema, table_name FROM information_schema.tables WHERE table_type='BASE TABLE' AND table_schema NOT IN ('information_schema', 'performance_schema');"
 
 type SQLType byte
@@ -46,8 +51,32 @@ const (
 	SQLTypeUpdate
 	SQLTypeDelete
 	SQLTypeQuery
+	SQLTypeDDL // schema changes, reverted with WithDDLRollback
 )
 
+// GenMode tells which statements are generated from the row images
+type GenMode byte
+
+const (
+	GenModeRollback GenMode = iota // statements reverting the changes
+	GenModeForward                 // the original statements, for auditing or replaying the changes elsewhere
+)
+
+func (t SQLType) String() string {
+	switch t {
+	case SQLTypeInsert:
+		return "insert"
+	case SQLTypeUpdate:
+		return "update"
+	case SQLTypeDelete:
+		return "delete"
+	case SQLTypeDDL:
+		return "ddl"
+	default:
+		return "query"
+	}
+}
+
 var bytesColumnTypes = []string{"blob", "json", "geometry", CUnknowncoltype}
 
 const BLOB = "blob"
@@ -0,0 +1,337 @@
+package mysqlbinlog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/types"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// ddlRe matches the table and database statements, which may change table structures or remove rows.
+// Other queries, e.g. CREATE USER or DROP VIEW, are not parsed.
+var ddlRe = regexp.MustCompile(`(?i)^\s*(` +
+	`CREATE\s+(OR\s+REPLACE\s+)?(TEMPORARY\s+)?(TABLE|DATABASE|SCHEMA)|` +
+	`CREATE\s+(ONLINE\s+|OFFLINE\s+)?(UNIQUE\s+|FULLTEXT\s+|SPATIAL\s+)?INDEX|` +
+	`ALTER\s+(ONLINE\s+|OFFLINE\s+)?(IGNORE\s+)?TABLE|` +
+	`DROP\s+(TEMPORARY\s+)?TABLE|DROP\s+(DATABASE|SCHEMA|INDEX)|` +
+	`RENAME\s+TABLES?|TRUNCATE)\b`)
+
+func isDDL(query string) bool {
+	return ddlRe.MatchString(query)
+}
+
+// tableStmts keeps the statements on tables and databases, the parser may accept others after the same keywords
+func tableStmts(stmts []ast.StmtNode) []ast.StmtNode {
+	var kept []ast.StmtNode
+	for _, stmt := range stmts {
+		switch st := stmt.(type) {
+		case *ast.DropTableStmt:
+			if st.IsView {
+				continue
+			}
+		case *ast.CreateTableStmt, *ast.AlterTableStmt, *ast.RenameTableStmt, *ast.TruncateTableStmt,
+			*ast.CreateIndexStmt, *ast.DropIndexStmt, *ast.CreateDatabaseStmt, *ast.DropDatabaseStmt:
+		default:
+			continue
+		}
+		kept = append(kept, stmt)
+	}
+	return kept
+}
+
+// applyDDL parses the query of a QUERY_EVENT ending at pos, and records the structures of the tables it changes
+// from pos on. schema is the default database of the query. The parsed statements are returned, none if the
+// query is not DDL or is applied already.
+func (s *tablesColumnsInfo) applyDDL(pos mysql.Position, schema string, query string) ([]ast.StmtNode, error) {
+	if !isDDL(query) {
+		return nil, nil
+	}
+	if s.ddlPos.Name != "" && pos.Compare(s.ddlPos) <= 0 {
+		return nil, nil
+	}
+	s.ddlPos = pos
+
+	if s.ddlParser == nil {
+		s.ddlParser = parser.New()
+	}
+	stmts, _, err := s.ddlParser.Parse(query, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DDL at %s, err=%s", pos.String(), err.Error())
+	}
+	stmts = tableStmts(stmts)
+	s.applyStmts(pos, schema, stmts)
+	return stmts, nil
+}
+
+// applyStmts records the structures of the tables changed by the parsed statements of a DDL query ending at pos
+func (s *tablesColumnsInfo) applyStmts(pos mysql.Position, schema string, stmts []ast.StmtNode) {
+	d := &ddlApplier{tbInfos: s, pos: pos, schema: schema}
+	for _, stmt := range stmts {
+		switch st := stmt.(type) {
+		case *ast.CreateTableStmt:
+			d.createTable(st)
+		case *ast.AlterTableStmt:
+			d.alterTable(st)
+		case *ast.DropTableStmt:
+			if st.IsView {
+				continue
+			}
+			for _, tn := range st.Tables {
+				d.set(d.tableKey(tn), nil)
+			}
+		case *ast.RenameTableStmt:
+			for _, t2t := range st.TableToTables {
+				d.rename(d.tableKey(t2t.OldTable), d.tableKey(t2t.NewTable))
+			}
+		case *ast.DropDatabaseStmt:
+			d.dropDatabase(st.Name)
+		case *ast.CreateDatabaseStmt:
+			// a new database has no tables, those of a dropped one with the same name are already marked dropped
+		}
+	}
+}
+
+// ddlApplier applies the statements of one DDL query
+type ddlApplier struct {
+	tbInfos *tablesColumnsInfo
+	pos     mysql.Position
+	schema  string
+}
+
+func (d *ddlApplier) tableKey(tn *ast.TableName) string {
+	schema := tn.Schema.O
+	if schema == "" {
+		schema = d.schema
+	}
+	return getTableName(schema, tn.Name.O)
+}
+
+func (d *ddlApplier) set(tbKey string, info *tblInfoJson) {
+	if info == nil {
+		logrus.Infof("table %s is dropped at %s", tbKey, d.pos.String())
+	} else {
+		logrus.Infof("table %s has %d columns from %s", tbKey, len(info.Columns), d.pos.String())
+	}
+	d.tbInfos.setVersion(tbKey, d.pos, info)
+}
+
+// current returns a copy of the structure of the table before the DDL
+func (d *ddlApplier) current(tbKey string) (*tblInfoJson, bool) {
+	info, ok := d.tbInfos.lookup(tbKey, d.pos)
+	if !ok {
+		return nil, false
+	}
+	return info.clone(), true
+}
+
+func (d *ddlApplier) createTable(st *ast.CreateTableStmt) {
+	tbKey := d.tableKey(st.Table)
+	if _, ok := d.tbInfos.lookup(tbKey, d.pos); ok && st.IfNotExists {
+		return
+	}
+	if st.ReferTable != nil {
+		// CREATE TABLE ... LIKE
+		info, ok := d.current(d.tableKey(st.ReferTable))
+		if !ok {
+			logrus.Infof("table %s created like unknown table %s at %s", tbKey, d.tableKey(st.ReferTable), d.pos.String())
+			return
+		}
+		info.AutoIncrement = 0
+		d.set(tbKey, info)
+		return
+	}
+
+	info := &tblInfoJson{PrimaryKey: keyInfo{}, UniqueKeys: []keyInfo{}}
+	for _, col := range st.Cols {
+		addColumnDef(info, col, len(info.Columns))
+	}
+	for _, c := range st.Constraints {
+		addConstraint(info, c)
+	}
+	d.set(tbKey, info)
+}
+
+func (d *ddlApplier) alterTable(st *ast.AlterTableStmt) {
+	tbKey := d.tableKey(st.Table)
+	info, ok := d.current(tbKey)
+	if !ok {
+		logrus.Infof("table %s altered at %s is unknown, skip it", tbKey, d.pos.String())
+		return
+	}
+	for _, spec := range st.Specs {
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			for _, col := range spec.NewColumns {
+				addColumnDef(info, col, columnPosition(info, spec.Position, len(info.Columns)))
+			}
+		case ast.AlterTableDropColumn:
+			dropColumn(info, spec.OldColumnName.Name.O)
+		case ast.AlterTableModifyColumn:
+			col := spec.NewColumns[0]
+			replaceColumnDef(info, col.Name.Name.O, col, spec.Position)
+		case ast.AlterTableChangeColumn:
+			replaceColumnDef(info, spec.OldColumnName.Name.O, spec.NewColumns[0], spec.Position)
+		case ast.AlterTableAddConstraint:
+			addConstraint(info, spec.Constraint)
+		case ast.AlterTableDropPrimaryKey:
+			info.PrimaryKey = keyInfo{}
+		case ast.AlterTableRenameTable:
+			// renaming and other changes in one statement, the renamed table gets them all below
+			d.set(tbKey, nil)
+			tbKey = d.tableKey(spec.NewTable)
+		}
+		// DROP INDEX is not tracked as unique keys are kept without names, the values of a dropped
+		// unique key still identify the rows changed before
+	}
+	d.set(tbKey, info)
+}
+
+func (d *ddlApplier) rename(from, to string) {
+	info, ok := d.current(from)
+	if !ok {
+		logrus.Infof("table %s renamed to %s at %s is unknown, skip it", from, to, d.pos.String())
+		return
+	}
+	d.set(from, nil)
+	d.set(to, info)
+}
+
+func (d *ddlApplier) dropDatabase(schema string) {
+	for _, table := range d.tbInfos.tablesIn(schema, d.pos) {
+		d.set(getTableName(schema, table), nil)
+	}
+}
+
+// columnField returns the fieldInfo of a column definition, with the type named like information_schema DATA_TYPE
+func columnField(col *ast.ColumnDef) fieldInfo {
+	f := fieldInfo{FieldName: col.Name.Name.O}
+	if col.Tp != nil {
+		f.FieldType = types.TypeToStr(col.Tp.Tp, col.Tp.Charset)
+	}
+	for _, opt := range col.Options {
+		switch opt.Tp {
+		case ast.ColumnOptionGenerated:
+			f.Extra = "VIRTUAL GENERATED"
+			if opt.Stored {
+				f.Extra = "STORED GENERATED"
+			}
+		case ast.ColumnOptionAutoIncrement:
+			f.Extra = "auto_increment"
+		}
+	}
+	return f
+}
+
+// addColumnDef inserts col at idx, and the keys declared with it
+func addColumnDef(info *tblInfoJson, col *ast.ColumnDef, idx int) {
+	f := columnField(col)
+	info.Columns = append(info.Columns, fieldInfo{})
+	copy(info.Columns[idx+1:], info.Columns[idx:])
+	info.Columns[idx] = f
+
+	for _, opt := range col.Options {
+		switch opt.Tp {
+		case ast.ColumnOptionPrimaryKey:
+			info.PrimaryKey = keyInfo{f.FieldName}
+		case ast.ColumnOptionUniqKey:
+			info.UniqueKeys = append(info.UniqueKeys, keyInfo{f.FieldName})
+		}
+	}
+}
+
+// columnPosition returns where FIRST or AFTER puts a column, def without them
+func columnPosition(info *tblInfoJson, pos *ast.ColumnPosition, def int) int {
+	if pos == nil {
+		return def
+	}
+	switch pos.Tp {
+	case ast.ColumnPositionFirst:
+		return 0
+	case ast.ColumnPositionAfter:
+		if i := columnIndex(info, pos.RelativeColumn.Name.O); i >= 0 {
+			return i + 1
+		}
+	}
+	return def
+}
+
+// replaceColumnDef replaces the column oldName by col, for MODIFY and CHANGE COLUMN
+func replaceColumnDef(info *tblInfoJson, oldName string, col *ast.ColumnDef, pos *ast.ColumnPosition) {
+	idx := columnIndex(info, oldName)
+	if idx < 0 {
+		addColumnDef(info, col, columnPosition(info, pos, len(info.Columns)))
+		return
+	}
+	renameInKeys(info, oldName, col.Name.Name.O)
+	info.Columns = append(info.Columns[:idx], info.Columns[idx+1:]...)
+	addColumnDef(info, col, columnPosition(info, pos, idx))
+}
+
+func dropColumn(info *tblInfoJson, name string) {
+	idx := columnIndex(info, name)
+	if idx < 0 {
+		return
+	}
+	info.Columns = append(info.Columns[:idx], info.Columns[idx+1:]...)
+	// MySQL shrinks the keys, a shrunk key may no longer be unique, so drop them
+	if ContainsString(info.PrimaryKey, name) {
+		info.PrimaryKey = keyInfo{}
+	}
+	var uniqueKeys []keyInfo
+	for _, k := range info.UniqueKeys {
+		if !ContainsString(k, name) {
+			uniqueKeys = append(uniqueKeys, k)
+		}
+	}
+	info.UniqueKeys = uniqueKeys
+}
+
+func renameInKeys(info *tblInfoJson, oldName, newName string) {
+	for i, name := range info.PrimaryKey {
+		if name == oldName {
+			info.PrimaryKey[i] = newName
+		}
+	}
+	for _, k := range info.UniqueKeys {
+		for i, name := range k {
+			if name == oldName {
+				k[i] = newName
+			}
+		}
+	}
+}
+
+func addConstraint(info *tblInfoJson, c *ast.Constraint) {
+	if c == nil {
+		return
+	}
+	var key keyInfo
+	for _, k := range c.Keys {
+		if k.Column != nil {
+			key = append(key, k.Column.Name.O)
+		}
+	}
+	if len(key) == 0 {
+		return
+	}
+	switch c.Tp {
+	case ast.ConstraintPrimaryKey:
+		info.PrimaryKey = key
+	case ast.ConstraintUniq, ast.ConstraintUniqKey, ast.ConstraintUniqIndex:
+		info.UniqueKeys = append(info.UniqueKeys, key)
+	}
+}
+
+func columnIndex(info *tblInfoJson, name string) int {
+	for i, col := range info.Columns {
+		if strings.EqualFold(col.FieldName, name) {
+			return i
+		}
+	}
+	return -1
+}
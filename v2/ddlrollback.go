@@ -0,0 +1,309 @@
+package mysqlbinlog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// ddlInverse collects the SQLs reverting one DDL query, in the order they are to be executed
+type ddlInverse struct {
+	sqls      []string
+	reasons   []string // why parts of the query can not be reverted
+	db, table string   // the first table touched, for the rollback entry
+}
+
+func (inv *ddlInverse) touch(db, table string) {
+	if inv.table == "" {
+		inv.db, inv.table = db, table
+	}
+}
+
+func (inv *ddlInverse) irreversible(format string, args ...interface{}) {
+	inv.reasons = append(inv.reasons, fmt.Sprintf(format, args...))
+}
+
+// genDDLRollback generates the SQLs reverting a DDL event, or the DDL itself with GenModeForward
+func (s *Session) genDDLRollback(ev myBinEvent) error {
+	posStr := getPosStr(ev.MyPos.Name, ev.StartPos, ev.MyPos.Pos)
+	inv := &ddlInverse{db: ev.DDL.Schema}
+	before := mysql.Position{Name: ev.MyPos.Name, Pos: ev.StartPos}
+	switch {
+	case !s.conf.DDLRollback:
+		// only watched for the tables to restore from shadow snapshots
+	case ev.DDL.Err != nil:
+		inv.irreversible("can not parse it, err=%s", ev.DDL.Err.Error())
+	case s.conf.GenMode == GenModeForward:
+		inv.sqls = []string{ev.Query}
+	default:
+		// revert the statements of the query latest first
+		for i := len(ev.DDL.Stmts) - 1; i >= 0; i-- {
+			s.invertDDL(inv, ev.DDL.Stmts[i], ev.DDL.Schema, before, ev.MyPos)
+		}
+	}
+
+	src := rollbackEntry{DB: inv.db, Table: inv.table, ThreadID: ev.ThreadID, GTID: ev.GTID, Query: ev.Query, Pos: posStr, SqlType: SQLTypeDDL}
+	if len(inv.sqls) > 0 {
+		// entries are executed latest first, so are the SQLs of one entry
+		sqls := ReverseSlice(inv.sqls)
+		if err := s.journal.appendEntries(sqls, src); err != nil {
+			return err
+		}
+		s.rollbackSQL.appendGeneralSQLs(sqls, src)
+	}
+	if len(inv.reasons) > 0 {
+		src.Irreversible = strings.Join(inv.reasons, "; ")
+		logrus.Warnf("DDL at %s can not be reverted, %s: %s", posStr, src.Irreversible, ev.Query)
+		if err := s.journal.appendEntries([]string{""}, src); err != nil {
+			return err
+		}
+		s.rollbackSQL.appendGeneralSQLs([]string{""}, src)
+	}
+	if s.conf.Shadow && s.conf.GenMode != GenModeForward && ev.DDL.Err == nil {
+		for _, tb := range s.wipedTables(ev.DDL.Stmts, ev.DDL.Schema, before) {
+			wiped := rollbackEntry{DB: tb[0], Table: tb[1], ThreadID: ev.ThreadID, GTID: ev.GTID, Query: ev.Query, Pos: posStr, SqlType: SQLTypeDDL, Wiped: true}
+			if err := s.journal.appendEntries([]string{""}, wiped); err != nil {
+				return err
+			}
+			s.rollbackSQL.appendGeneralSQLs([]string{""}, wiped)
+		}
+	}
+	return nil
+}
+
+func (s *Session) invertDDL(inv *ddlInverse, stmt ast.StmtNode, schema string, before, after mysql.Position) {
+	switch st := stmt.(type) {
+	case *ast.CreateTableStmt:
+		db, tb := tableOf(st.Table, schema)
+		inv.touch(db, tb)
+		if _, existed := s.tableinfo.lookup(getTableName(db, tb), before); existed && st.IfNotExists {
+			return
+		}
+		inv.sqls = append(inv.sqls, "DROP TABLE IF EXISTS "+quoteName(db, tb))
+	case *ast.DropTableStmt:
+		if st.IsView {
+			inv.irreversible("views are not tracked")
+			return
+		}
+		for _, tn := range st.Tables {
+			db, tb := tableOf(tn, schema)
+			inv.touch(db, tb)
+			if _, existed := s.tableinfo.lookup(getTableName(db, tb), before); !existed {
+				continue
+			}
+			s.recreateTable(inv, db, tb, before)
+		}
+	case *ast.RenameTableStmt:
+		var pairs []string
+		for i := len(st.TableToTables) - 1; i >= 0; i-- {
+			oldDB, oldTb := tableOf(st.TableToTables[i].OldTable, schema)
+			newDB, newTb := tableOf(st.TableToTables[i].NewTable, schema)
+			inv.touch(oldDB, oldTb)
+			inv.touch(newDB, newTb)
+			pairs = append(pairs, quoteName(newDB, newTb)+" TO "+quoteName(oldDB, oldTb))
+		}
+		inv.sqls = append(inv.sqls, "RENAME TABLE "+strings.Join(pairs, ", "))
+	case *ast.AlterTableStmt:
+		s.invertAlterTable(inv, st, schema, before, after)
+	case *ast.CreateIndexStmt:
+		db, tb := tableOf(st.Table, schema)
+		inv.touch(db, tb)
+		inv.sqls = append(inv.sqls, fmt.Sprintf("DROP INDEX %s ON %s", quoteIdent(st.IndexName), quoteName(db, tb)))
+	case *ast.DropIndexStmt:
+		db, tb := tableOf(st.Table, schema)
+		inv.touch(db, tb)
+		snapshot, _ := s.definitions.at(getTableName(db, tb), before)
+		def, ok := indexDefinition(snapshot, st.IndexName)
+		if !ok {
+			inv.irreversible("no definition of index %s of %s in the snapshots", st.IndexName, getTableName(db, tb))
+			return
+		}
+		inv.sqls = append(inv.sqls, fmt.Sprintf("ALTER TABLE %s ADD %s", quoteName(db, tb), def))
+	case *ast.CreateDatabaseStmt:
+		if len(s.tableinfo.tablesIn(st.Name, before)) > 0 {
+			// IF NOT EXISTS on a database in use
+			return
+		}
+		if st.IfNotExists {
+			inv.irreversible("can not tell whether database %s existed before", st.Name)
+			return
+		}
+		inv.sqls = append(inv.sqls, "DROP DATABASE IF EXISTS "+quoteIdent(st.Name))
+	case *ast.DropDatabaseStmt:
+		inv.sqls = append(inv.sqls, "CREATE DATABASE IF NOT EXISTS "+quoteIdent(st.Name))
+		for _, tb := range s.tableinfo.tablesIn(st.Name, before) {
+			inv.touch(st.Name, tb)
+			s.recreateTable(inv, st.Name, tb, before)
+		}
+	case *ast.TruncateTableStmt:
+		db, tb := tableOf(st.Table, schema)
+		inv.touch(db, tb)
+		inv.irreversible("rows removed by TRUNCATE TABLE %s are not in the binlog", getTableName(db, tb))
+	default:
+		inv.irreversible("%s is not supported", strings.TrimPrefix(fmt.Sprintf("%T", stmt), "*ast."))
+	}
+}
+
+// recreateTable re-creates a table dropped after before from its snapshot, its rows are not in the binlog
+func (s *Session) recreateTable(inv *ddlInverse, db, tb string, before mysql.Position) {
+	snapshot, ok := s.definitions.at(getTableName(db, tb), before)
+	if !ok {
+		inv.irreversible("no SHOW CREATE TABLE snapshot of %s", getTableName(db, tb))
+		return
+	}
+	logrus.Warnf("table %s is re-created empty on rollback, its rows are not in the binlog", getTableName(db, tb))
+	inv.sqls = append(inv.sqls, createTableAs(snapshot, db, tb))
+}
+
+func (s *Session) invertAlterTable(inv *ddlInverse, st *ast.AlterTableStmt, schema string, before, after mysql.Position) {
+	db, tb := tableOf(st.Table, schema)
+	curDB, curTb := db, tb
+	inv.touch(db, tb)
+	snapshot, _ := s.definitions.at(getTableName(db, tb), before)
+
+	var specs []string
+	rebuild := false
+	renamed := map[string]string{} // old column name => new one
+	for _, spec := range st.Specs {
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			for _, col := range spec.NewColumns {
+				specs = append(specs, "DROP COLUMN "+quoteIdent(col.Name.Name.O))
+			}
+		case ast.AlterTableAddConstraint:
+			c := spec.Constraint
+			switch {
+			case c.Tp == ast.ConstraintPrimaryKey:
+				specs = append(specs, "DROP PRIMARY KEY")
+			case c.Name != "" && (c.Tp == ast.ConstraintKey || c.Tp == ast.ConstraintIndex || c.Tp == ast.ConstraintUniq ||
+				c.Tp == ast.ConstraintUniqKey || c.Tp == ast.ConstraintUniqIndex || c.Tp == ast.ConstraintFulltext):
+				specs = append(specs, "DROP INDEX "+quoteIdent(c.Name))
+			default:
+				rebuild = true
+			}
+		case ast.AlterTableDropIndex, ast.AlterTableDropPrimaryKey:
+			def, ok := indexDefinition(snapshot, spec.Name)
+			if !ok {
+				rebuild = true
+				continue
+			}
+			specs = append(specs, "ADD "+def)
+		case ast.AlterTableChangeColumn:
+			renamed[spec.OldColumnName.Name.O] = spec.NewColumns[0].Name.Name.O
+			rebuild = true
+		case ast.AlterTableRenameTable:
+			curDB, curTb = tableOf(spec.NewTable, schema)
+			inv.touch(curDB, curTb)
+		default:
+			rebuild = true
+		}
+	}
+
+	if !rebuild {
+		if curDB != db || curTb != tb {
+			specs = append(specs, "RENAME TO "+quoteName(db, tb))
+		}
+		if len(specs) > 0 {
+			inv.sqls = append(inv.sqls, fmt.Sprintf("ALTER TABLE %s %s", quoteName(curDB, curTb), strings.Join(ReverseSlice(specs), ", ")))
+		}
+		return
+	}
+
+	// no simple inverse, copy the rows into a table created from the snapshot
+	if snapshot == "" {
+		inv.irreversible("no SHOW CREATE TABLE snapshot of %s to rebuild it", getTableName(db, tb))
+		return
+	}
+	oldInfo, ok1 := s.tableinfo.lookup(getTableName(db, tb), before)
+	newInfo, ok2 := s.tableinfo.lookup(getTableName(curDB, curTb), after)
+	if !ok1 || !ok2 {
+		inv.irreversible("columns of %s before and after it are unknown", getTableName(db, tb))
+		return
+	}
+	var cols, exprs []string
+	for _, col := range oldInfo.Columns {
+		if strings.Contains(col.Extra, "GENERATED") {
+			continue
+		}
+		name := col.FieldName
+		if newName, ok := renamed[name]; ok {
+			name = newName
+		}
+		if columnIndex(newInfo, name) < 0 {
+			logrus.Warnf("column %s of %s is dropped at %s, it is re-created with its default value on rollback", col.FieldName, getTableName(db, tb), after.String())
+			continue
+		}
+		cols = append(cols, quoteIdent(col.FieldName))
+		exprs = append(exprs, quoteIdent(name))
+	}
+	tmpTb := rebuildTableName(tb)
+	inv.sqls = append(inv.sqls,
+		"DROP TABLE IF EXISTS "+quoteName(db, tmpTb),
+		createTableAs(snapshot, db, tmpTb),
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quoteName(db, tmpTb), strings.Join(cols, ", "), strings.Join(exprs, ", "), quoteName(curDB, curTb)),
+		"DROP TABLE "+quoteName(curDB, curTb),
+		fmt.Sprintf("RENAME TABLE %s TO %s", quoteName(db, tmpTb), quoteName(db, tb)),
+	)
+}
+
+func (s *Session) showCreateTable(db, tb string) (string, error) {
+	con, err := s.getDBCon()
+	if err != nil {
+		return "", err
+	}
+	row, err := queryRowByName(con, "SHOW CREATE TABLE "+quoteName(db, tb))
+	if err != nil {
+		return "", err
+	}
+	snapshot, ok := row["Create Table"]
+	if !ok {
+		return "", fmt.Errorf("%s is not a base table", getTableName(db, tb))
+	}
+	return snapshot, nil
+}
+
+func tableOf(tn *ast.TableName, schema string) (string, string) {
+	if tn.Schema.O != "" {
+		schema = tn.Schema.O
+	}
+	return schema, tn.Name.O
+}
+
+// createTableAs turns the SHOW CREATE TABLE snapshot of a table into the creation of db.tb
+func createTableAs(snapshot string, db, tb string) string {
+	idx := strings.Index(snapshot, "(")
+	if idx < 0 {
+		return snapshot
+	}
+	return fmt.Sprintf("CREATE TABLE %s %s", quoteName(db, tb), snapshot[idx:])
+}
+
+// indexDefinition finds the definition of an index in a SHOW CREATE TABLE snapshot, the primary key if name is empty
+func indexDefinition(snapshot string, name string) (string, bool) {
+	for _, line := range strings.Split(snapshot, "\n") {
+		line = strings.TrimSuffix(strings.TrimSpace(line), ",")
+		if name == "" || strings.EqualFold(name, "PRIMARY") {
+			if strings.HasPrefix(line, "PRIMARY KEY (") {
+				return line, true
+			}
+			continue
+		}
+		idx := strings.Index(line, "KEY "+quoteIdent(name)+" (")
+		if idx >= 0 && !strings.Contains(line[:idx], "(") {
+			return line, true
+		}
+	}
+	return "", false
+}
+
+// rebuildTableName names the table an ALTER is reverted into, MySQL allows 64 characters
+func rebuildTableName(tb string) string {
+	const suffix = "_rollback"
+	if len(tb)+len(suffix) > 64 {
+		tb = tb[:64-len(suffix)]
+	}
+	return tb + suffix
+}
@@ -0,0 +1,159 @@
+package mysqlbinlog
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func binlogPos(pos uint32) mysql.Position {
+	return mysql.Position{Name: "binlog.000001", Pos: pos}
+}
+
+func TestTableDefinitionsAt(t *testing.T) {
+	var d tableDefinitions
+	d.add("shop.orders", tableDefinition{from: binlogPos(10), to: binlogPos(20), sql: "v1"})
+	d.changed("shop.orders", binlogPos(100))
+	d.add("shop.orders", tableDefinition{from: binlogPos(150), to: binlogPos(160), sql: "v2"})
+	d.changed("shop.orders", binlogPos(300))
+	// read while the server ran the second DDL already, the listener did not see it yet
+	d.add("shop.orders", tableDefinition{from: binlogPos(200), to: binlogPos(320), sql: "v3"})
+
+	tests := []struct {
+		pos  uint32
+		want string
+	}{
+		{5, ""},    // before any definition was read
+		{90, "v1"}, // before the first DDL
+		{140, ""},  // after the first DDL, before the definition was read again
+		{290, "v2"},
+		{400, ""}, // v3 spans the second DDL, it may be the definition before or after it
+	}
+	for _, tc := range tests {
+		got, ok := d.at("shop.orders", binlogPos(tc.pos))
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("at(%d) = %q, %v, want %q", tc.pos, got, ok, tc.want)
+		}
+	}
+	if d.current("shop.orders") {
+		t.Error("current = true, but v3 may be read before the last DDL")
+	}
+	d.add("shop.orders", tableDefinition{from: binlogPos(350), to: binlogPos(360), sql: "v4"})
+	if got, _ := d.at("shop.orders", binlogPos(400)); got != "v4" || !d.current("shop.orders") {
+		t.Errorf("at(400) = %q, current = %v, want v4 and true", got, d.current("shop.orders"))
+	}
+	d.changed("shop.orders", binlogPos(500))
+	if d.current("shop.orders") {
+		t.Error("current = true after a DDL")
+	}
+}
+
+func TestTrackDefinitionsFromQuery(t *testing.T) {
+	s := &Session{conf: &ConfCmd{DDLRollback: true}}
+	create := "CREATE TABLE `tmp` (`id` int NOT NULL)"
+	s.trackDefinitions(binlogPos(200), 100, "shop", create,
+		[]ast.StmtNode{&ast.CreateTableStmt{Table: tableName("", "tmp")}}, false)
+	s.trackDefinitions(binlogPos(400), 300, "shop", "RENAME TABLE tmp TO tmp2",
+		[]ast.StmtNode{&ast.RenameTableStmt{TableToTables: []*ast.TableToTable{{OldTable: tableName("", "tmp"), NewTable: tableName("", "tmp2")}}}}, false)
+
+	// the table is dropped before the listener could read it from the server
+	if got, ok := s.definitions.at("shop.tmp", binlogPos(300)); !ok || got != create {
+		t.Errorf("definition of shop.tmp = %q, %v, want the CREATE TABLE", got, ok)
+	}
+	if _, ok := s.definitions.at("shop.tmp", binlogPos(500)); ok {
+		t.Error("shop.tmp has a definition after it is renamed")
+	}
+	if got, ok := s.definitions.at("shop.tmp2", binlogPos(500)); !ok || got != create {
+		t.Errorf("definition of shop.tmp2 = %q, %v, want the one of shop.tmp", got, ok)
+	}
+}
+
+func TestInvertDDL(t *testing.T) {
+	s := &Session{conf: &ConfCmd{DDLRollback: true}}
+	s.tableinfo.tableInfos = map[string]*tblInfoJson{"shop.orders": {Columns: []fieldInfo{{FieldName: "id", FieldType: "int"}}}}
+	s.definitions.add("shop.orders", tableDefinition{from: binlogPos(10), to: binlogPos(20), sql: "CREATE TABLE `orders` (\\n  `id` int NOT NULL\\n)"})
+	before, after := binlogPos(100), binlogPos(200)
+
+	col := &ast.ColumnDef{Name: &ast.ColumnName{Name: model.CIStr{O: "note", L: "note"}}}
+	tests := []struct {
+		name       string
+		stmt       ast.StmtNode
+		want       []string
+		reversible bool
+	}{
+		{"create table", &ast.CreateTableStmt{Table: tableName("", "tmp")}, []string{"DROP TABLE IF EXISTS `shop`.`tmp`"}, true},
+		{"create table if not exists", &ast.CreateTableStmt{IfNotExists: true, Table: tableName("", "orders")}, nil, true},
+		{"drop table", &ast.DropTableStmt{Tables: []*ast.TableName{tableName("shop", "orders")}}, []string{"CREATE TABLE `shop`.`orders` (\\n  `id` int NOT NULL\\n)"}, true},
+		{"rename table", &ast.RenameTableStmt{TableToTables: []*ast.TableToTable{{OldTable: tableName("", "orders"), NewTable: tableName("", "orders2")}}},
+			[]string{"RENAME TABLE `shop`.`orders2` TO `shop`.`orders`"}, true},
+		{"add column", &ast.AlterTableStmt{Table: tableName("", "orders"), Specs: []*ast.AlterTableSpec{{Tp: ast.AlterTableAddColumns, NewColumns: []*ast.ColumnDef{col}}}},
+			[]string{"ALTER TABLE `shop`.`orders` DROP COLUMN `note`"}, true},
+		{"truncate", &ast.TruncateTableStmt{Table: tableName("", "orders")}, nil, false},
+		{"drop view", &ast.DropTableStmt{Tables: []*ast.TableName{tableName("", "v")}, IsView: true}, nil, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			inv := &ddlInverse{}
+			s.invertDDL(inv, tc.stmt, "shop", before, after)
+			if strings.Join(inv.sqls, ";") != strings.Join(tc.want, ";") {
+				t.Errorf("sqls = %q, want %q", inv.sqls, tc.want)
+			}
+			if reversible := len(inv.reasons) == 0; reversible != tc.reversible {
+				t.Errorf("irreversible reasons %q, want reversible=%v", inv.reasons, tc.reversible)
+			}
+		})
+	}
+
+	// a table dropped before any definition of it was read can not be re-created
+	inv := &ddlInverse{}
+	s.tableinfo.tableInfos["shop.items"] = &tblInfoJson{}
+	s.invertDDL(inv, &ast.DropTableStmt{Tables: []*ast.TableName{tableName("", "items")}}, "shop", before, after)
+	if len(inv.sqls) != 0 || len(inv.reasons) != 1 {
+		t.Errorf("drop of a table without definition = %q, %q, want irreversible", inv.sqls, inv.reasons)
+	}
+}
+
+func TestIsDDL(t *testing.T) {
+	ddl := []string{
+		"CREATE TABLE t (id int)", "create temporary table t (id int)", "CREATE OR REPLACE TABLE t (id int)",
+		"CREATE DATABASE shop", "create schema if not exists shop", "CREATE UNIQUE INDEX i ON t (id)",
+		"ALTER TABLE t ADD COLUMN c int", "ALTER ONLINE TABLE t ADD COLUMN c int", "  DROP TABLE IF EXISTS t",
+		"DROP TEMPORARY TABLE t", "DROP DATABASE shop", "DROP INDEX i ON t", "RENAME TABLE a TO b", "TRUNCATE t",
+	}
+	for _, query := range ddl {
+		if !isDDL(query) {
+			t.Errorf("isDDL(%q) = false, want true", query)
+		}
+	}
+	other := []string{
+		"CREATE USER 'u'@'%' IDENTIFIED BY 'p'", "DROP USER u", "ALTER USER u ACCOUNT LOCK", "RENAME USER a TO b",
+		"CREATE VIEW v AS SELECT 1", "CREATE DEFINER=`root`@`%` VIEW v AS SELECT 1", "DROP VIEW v",
+		"CREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW SET NEW.id = 1", "DROP PROCEDURE p",
+		"CREATE EVENT e ON SCHEDULE EVERY 1 DAY DO SELECT 1", "CREATE ROLE r", "ALTER DATABASE shop CHARACTER SET utf8mb4",
+		"CREATE TABLESPACE ts ADD DATAFILE 'ts.ibd'", "INSERT INTO t VALUES (1)",
+	}
+	for _, query := range other {
+		if isDDL(query) {
+			t.Errorf("isDDL(%q) = true, want false", query)
+		}
+	}
+}
+
+func TestTableStmts(t *testing.T) {
+	create := &ast.CreateTableStmt{Table: tableName("", "t")}
+	truncate := &ast.TruncateTableStmt{Table: tableName("", "t")}
+	stmts := []ast.StmtNode{
+		create,
+		&ast.CreateUserStmt{},
+		&ast.DropTableStmt{Tables: []*ast.TableName{tableName("", "v")}, IsView: true},
+		&ast.CreateViewStmt{},
+		truncate,
+	}
+	got := tableStmts(stmts)
+	if len(got) != 2 || got[0] != create || got[1] != truncate {
+		t.Errorf("tableStmts = %v, want the CREATE TABLE and the TRUNCATE", got)
+	}
+}
@@ -0,0 +1,68 @@
+package mysqlbinlog
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// ErrStopped is returned by a session after Stop
+var ErrStopped = errors.New("mysqlbinlog session is stopped")
+
+// TimeoutError is returned by BeginContext/RollbackContext when the context is done
+// before the marker shows up in the binlog or before the rollback SQLs are executed.
+type TimeoutError struct {
+	MarkerID    int64
+	LastPos     mysql.Position // position of the last binlog event received by the listener
+	LastGTIDSet string         // GTID set received by the listener, empty without gtid_mode
+	Err         error          // the context error
+}
+
+func (e *TimeoutError) Error() string {
+	if e.LastGTIDSet != "" {
+		return fmt.Sprintf("gave up waiting for marker ID %d, last binlog position seen is %s, GTID set seen is %s, err=%s", e.MarkerID, e.LastPos.String(), e.LastGTIDSet, e.Err.Error())
+	}
+	return fmt.Sprintf("gave up waiting for marker ID %d, last binlog position seen is %s, err=%s", e.MarkerID, e.LastPos.String(), e.Err.Error())
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// RollbackError is returned when a rollback statement fails. The statements before it in the same
+// transaction are rolled back too, unless the failing one is an auto increment reset which runs after the commit.
+type RollbackError struct {
+	MarkerID  int64
+	Index     int // index of the failing statement in the statements returned by PreviewRollback: the reverted changes, the restores from shadow snapshots, then the auto increment resets
+	Total     int // number of those statements
+	Statement RollbackStatement
+	Committed bool // true if the reverting changes were committed before the failure
+	Err       error
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("failed to execute rollback statement %d/%d on %s.%s (binlog pos %s), markerID=%d committed=%t sql=%q err=%s",
+		e.Index+1, e.Total, e.Statement.DB, e.Statement.Table, e.Statement.Pos, e.MarkerID, e.Committed, e.Statement.SQL, e.Err.Error())
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// IrreversibleDDLError is returned by Rollback when changes in the rolled back range can not be reverted:
+// schema changes with WithDDLRollback, or row changes whose partial row image lacks the columns needed.
+// Everything else is rolled back, Statements tell the changes left behind.
+type IrreversibleDDLError struct {
+	MarkerID   int64
+	Statements []RollbackStatement // Query is the DDL or the rows query, Irreversible tells why it can not be reverted
+}
+
+func (e *IrreversibleDDLError) Error() string {
+	msgs := make([]string, len(e.Statements))
+	for i, stmt := range e.Statements {
+		msgs[i] = fmt.Sprintf("%q at %s: %s", stmt.Query, stmt.Pos, stmt.Irreversible)
+	}
+	return fmt.Sprintf("rollback executed, but %d change(s) can not be reverted, markerID=%d: %s", len(e.Statements), e.MarkerID, strings.Join(msgs, "; "))
+}
@@ -24,12 +24,16 @@ func main() {
 
 	// run case 0 - 9
 	for i := 0; i < 10; i++ {
-		mysqlbinlog.Begin()
+		if err := mysqlbinlog.Begin(); err != nil {
+			logrus.Panicf("Error to begin case %d, err=%v", i, err)
+		}
 		// run case, execute INSERT, DELETE, UPDATE
 		time.Sleep(time.Second * 2)
 
 		// rollback
-		mysqlbinlog.Rollback()
+		if err := mysqlbinlog.Rollback(); err != nil {
+			logrus.Panicf("Error to rollback case %d, err=%v", i, err)
+		}
 	}
 
 	// stop listening before exit
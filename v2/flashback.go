@@ -0,0 +1,271 @@
+package mysqlbinlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/sirupsen/logrus"
+)
+
+// errStopParsing is returned by the parse callback once the stop position or datetime is passed
+var errStopParsing = errors.New("stop parsing")
+
+// Flashback generates the rollback SQLs of the changes recorded in local binlog files, without
+// a live binlog stream. files must be given in binlog order. The range is narrowed by WithStartPosition,
+// WithStopPosition, WithStartDatetime and WithStopDatetime, the table schemas come from
+// WithSchemaFile or from a server given by WithSchemaFrom.
+// The statements revert the latest change first, auto increment ids are left alone.
+// With WithGenMode(GenModeForward) the original statements are returned in binlog order instead.
+func Flashback(ctx context.Context, files []string, opts ...Option) ([]RollbackStatement, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no binlog file to flashback")
+	}
+	conf := newConfCmd("", 0, "", "", opts...)
+	if conf.SchemaFile == "" && conf.Host == "" {
+		return nil, fmt.Errorf("no table schema source, use WithSchemaFile or WithSchemaFrom")
+	}
+	if conf.BinlogTimeLocation == nil {
+		conf.BinlogTimeLocation = time.UTC
+	}
+	if conf.Flavor == "" {
+		flavor, err := binlogFlavor(files[0])
+		if err != nil {
+			return nil, err
+		}
+		conf.Flavor = flavor
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := &Session{
+		conf:      conf,
+		eventChan: make(chan myBinEvent, 100),
+		rollbackSQL: &RollbackSQL{
+			sqls: make(chan rollbackEntry, 1000),
+			stop: ctx.Done(),
+		},
+		done:       make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+		schemaOnly: true,
+	}
+	defer func() {
+		if s.sqlCon != nil {
+			_ = s.sqlCon.Close()
+		}
+	}()
+
+	if err := s.getTableInfo(mysql.Position{}); err != nil {
+		return nil, fmt.Errorf("failed to get table info, err=%s", err.Error())
+	}
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		defer close(s.eventChan)
+		if err := s.parseBinlogFiles(files); err != nil {
+			s.setErr(err)
+		}
+	}()
+	go s.startGenRollbackSql()
+
+	var entries []rollbackEntry
+	for entry := range s.rollbackSQL.sqls {
+		if entry.MarkerID >= 0 {
+			// markers of a session which was listening the server when the binlog was written
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	s.wg.Wait()
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if conf.GenMode == GenModeForward {
+		var stmts []RollbackStatement
+		for _, entry := range entries {
+			if stmt := entry.statement(); stmt.SQL != "" || stmt.Irreversible != "" {
+				stmts = append(stmts, stmt)
+			}
+		}
+		stmts = filterStatements(stmts, conf.Filter)
+		logrus.Infof("flashback generated %d forward SQLs from %d binlog files", len(stmts), len(files))
+		return stmts, nil
+	}
+	stmts, _ := splitRollbackStatements(entries, &s.tableinfo)
+	// DDL which can not be reverted, with an empty SQL
+	stmts = append(stmts, irreversibleStatements(entries)...)
+	stmts = filterStatements(stmts, conf.Filter)
+	logrus.Infof("flashback generated %d rollback SQLs from %d binlog files", len(stmts), len(files))
+	return stmts, nil
+}
+
+// filterStatements returns the statements keep returns true for, all of them if keep is nil
+func filterStatements(stmts []RollbackStatement, keep func(RollbackStatement) bool) []RollbackStatement {
+	if keep == nil {
+		return stmts
+	}
+	kept := stmts[:0]
+	for _, stmt := range stmts {
+		if keep(stmt) {
+			kept = append(kept, stmt)
+		}
+	}
+	return kept
+}
+
+// WriteFlashback is Flashback writing the SQLs to w, each one is preceded by a comment
+// with the binlog position of its change.
+func WriteFlashback(ctx context.Context, w io.Writer, files []string, opts ...Option) error {
+	stmts, err := Flashback(ctx, files, opts...)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		comment := stmt.Pos
+		if stmt.GTID != "" {
+			comment += " " + stmt.GTID
+		}
+		if stmt.Irreversible != "" {
+			if _, err := fmt.Fprintf(w, "-- %s\n-- can not revert %q: %s\n", comment, stmt.Query, stmt.Irreversible); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "-- %s\n%s;\n", comment, stmt.SQL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBinlogFiles feeds the rows events of files within the configured range to the generator
+func (s *Session) parseBinlogFiles(files []string) error {
+	start, stop, err := s.fileRange(files)
+	if err != nil {
+		return err
+	}
+
+	parser := replication.NewBinlogParser()
+	parser.SetFlavor(s.conf.Flavor)
+	parser.SetTimestampStringLocation(s.conf.BinlogTimeLocation)
+	parser.SetParseTime(false) // take mysql datetime/time column as string
+	parser.SetUseDecimal(true) // keep DECIMAL exact, see literal
+
+	for i := start; i <= stop; i++ {
+		name := filepath.Base(files[i])
+		var offset int64
+		if i == start && s.conf.StartPos.Name != "" {
+			offset = int64(s.conf.StartPos.Pos)
+		}
+		logrus.Infof("start to parse binlog file %s from %d", files[i], offset)
+
+		tracker := &eventTracker{session: s, currentBinlog: name, offline: true}
+		stopped := false
+		err := parser.ParseFile(files[i], offset, func(ev *replication.BinlogEvent) error {
+			if err := s.ctx.Err(); err != nil {
+				return err
+			}
+			if s.passedStop(name, ev) {
+				stopped = true
+				return errStopParsing
+			}
+			oneMyEvent, err := tracker.track(ev)
+			if err != nil || oneMyEvent == nil {
+				return err
+			}
+			if !s.conf.StartTime.IsZero() && int64(ev.Header.Timestamp) < s.conf.StartTime.Unix() {
+				return nil
+			}
+			select {
+			case s.eventChan <- *oneMyEvent:
+				return nil
+			case <-s.done:
+				return errStopParsing
+			case <-s.ctx.Done():
+				return s.ctx.Err()
+			}
+		})
+		if stopped {
+			return nil
+		}
+		if err != nil {
+			if s.ctx.Err() != nil || s.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to parse binlog file %s, err=%s", files[i], err.Error())
+		}
+	}
+	return nil
+}
+
+// binlogFlavor tells the flavor of the server which wrote file, from the version in its format description event
+func binlogFlavor(file string) (string, error) {
+	var flavor string
+	err := replication.NewBinlogParser().ParseFile(file, 0, func(ev *replication.BinlogEvent) error {
+		if fde, ok := ev.Event.(*replication.FormatDescriptionEvent); ok {
+			flavor = parseServerVersion(string(fde.ServerVersion)).flavor()
+		}
+		return errStopParsing
+	})
+	if flavor != "" {
+		// err is errStopParsing
+		return flavor, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the format description event of binlog file %s, err=%s", file, err.Error())
+	}
+	return "", fmt.Errorf("binlog file %s does not start with a format description event", file)
+}
+
+// fileRange returns the indexes of the files holding the start and stop positions
+func (s *Session) fileRange(files []string) (int, int, error) {
+	start, stop := 0, len(files)-1
+	if name := s.conf.StartPos.Name; name != "" {
+		start = -1
+		for i, f := range files {
+			if filepath.Base(f) == name {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			return 0, 0, fmt.Errorf("start binlog file %s is not in the files to flashback", name)
+		}
+	}
+	if name := s.conf.StopPos.Name; name != "" {
+		stop = -1
+		for i := start; i < len(files); i++ {
+			if filepath.Base(files[i]) == name {
+				stop = i
+				break
+			}
+		}
+		if stop < 0 {
+			return 0, 0, fmt.Errorf("stop binlog file %s is not in the files to flashback after the start one", name)
+		}
+	}
+	return start, stop, nil
+}
+
+// passedStop tells whether ev ends after the stop position or is made after the stop datetime
+func (s *Session) passedStop(name string, ev *replication.BinlogEvent) bool {
+	if s.conf.StopPos.Name == name && ev.Header.LogPos > s.conf.StopPos.Pos {
+		return true
+	}
+	// the format description event of a file carries the creation time of the file, not of a change
+	if ev.Header.EventType == replication.FORMAT_DESCRIPTION_EVENT || ev.Header.Timestamp == 0 {
+		return false
+	}
+	return !s.conf.StopTime.IsZero() && int64(ev.Header.Timestamp) > s.conf.StopTime.Unix()
+}
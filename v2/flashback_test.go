@@ -0,0 +1,41 @@
+package mysqlbinlog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterStatements(t *testing.T) {
+	stmts := func() []RollbackStatement {
+		return []RollbackStatement{
+			{SQL: "INSERT 1", Table: "orders", Pos: "binlog.000001 100-200", Type: SQLTypeInsert},
+			{SQL: "UPDATE 1", Table: "items", Pos: "binlog.000001 200-300", Type: SQLTypeUpdate},
+			{SQL: "DELETE 1", Table: "orders", Pos: "binlog.000001 300-400", Type: SQLTypeDelete},
+			{SQL: "INSERT 2", Table: "items", Pos: "binlog.000001 400-500", Type: SQLTypeInsert},
+			{SQL: "UPDATE 2", Table: "orders", Pos: "binlog.000001 500-600", Type: SQLTypeUpdate},
+		}
+	}
+	sqls := func(stmts []RollbackStatement) []string {
+		var out []string
+		for _, stmt := range stmts {
+			out = append(out, stmt.SQL)
+		}
+		return out
+	}
+
+	if got := sqls(filterStatements(stmts(), nil)); !reflect.DeepEqual(got, sqls(stmts())) {
+		t.Errorf("filterStatements without filter = %v, want all of them", got)
+	}
+	byTable := func(stmt RollbackStatement) bool { return stmt.Table == "orders" }
+	if got, want := sqls(filterStatements(stmts(), byTable)), []string{"INSERT 1", "DELETE 1", "UPDATE 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filterStatements by table = %v, want %v in binlog order", got, want)
+	}
+	noDelete := func(stmt RollbackStatement) bool { return stmt.Type != SQLTypeDelete }
+	if got, want := sqls(filterStatements(stmts(), noDelete)), []string{"INSERT 1", "UPDATE 1", "INSERT 2", "UPDATE 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filterStatements by type = %v, want %v in binlog order", got, want)
+	}
+	none := func(RollbackStatement) bool { return false }
+	if got := filterStatements(stmts(), none); len(got) != 0 {
+		t.Errorf("filterStatements keeping nothing = %v, want none", got)
+	}
+}
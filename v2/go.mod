@@ -6,7 +6,9 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/manilion/godropbox v1.0.1
+	github.com/pingcap/parser v3.0.17-0.20200720062348-6dc68ab12230+incompatible
 	github.com/pingcap/tidb v3.0.17+incompatible
+	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24
 	github.com/siddontang/go-mysql v1.1.0
 	github.com/sirupsen/logrus v1.9.3
 	gopkg.in/volatiletech/null.v6 v6.0.0-20170828023728-0bef4e07ae1b
@@ -19,12 +21,10 @@ require (
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/pingcap/errors v0.11.4 // indirect
 	github.com/pingcap/log v0.0.0-20190715063458-479153f07ebd // indirect
-	github.com/pingcap/parser v3.0.17-0.20200720062348-6dc68ab12230+incompatible // indirect
 	github.com/pingcap/tipb v0.0.0-20200426072559-d2c068e96eb3 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20190512091148-babf20351dd7 // indirect
 	github.com/satori/go.uuid v1.2.0 // indirect
 	github.com/shirou/gopsutil v2.18.10+incompatible // indirect
-	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24 // indirect
 	github.com/siddontang/go v0.0.0-20180604090527-bdc77568d726 // indirect
 	github.com/siddontang/go-log v0.0.0-20180807004314-8d05993dda07 // indirect
 	go.uber.org/atomic v1.3.2 // indirect
@@ -0,0 +1,288 @@
+package mysqlbinlog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// journal records the rollback entries on disk as JSON lines, so that the changes of a crashed
+// process can still be rolled back by RecoverAndRollback. An entry is outstanding until a
+// "done" record lists its position, which is written when it is rolled back or discarded by Begin.
+type journal struct {
+	mu          sync.Mutex
+	path        string
+	f           *os.File
+	outstanding map[string]int // position of the change => count of its outstanding entries
+}
+
+const (
+	journalSession = "session" // header, where and how to roll back
+	journalBegin   = "begin"
+	journalEntry   = "entry"
+	journalDone    = "done"
+)
+
+type journalRecord struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// session
+	Host           string            `json:"host,omitempty"`
+	Port           uint              `json:"port,omitempty"`
+	User           string            `json:"user,omitempty"`
+	AutoIncrements map[string]uint64 `json:"auto_increments,omitempty"` // db.table => auto increment id when the session starts, or the cycle begins
+
+	// begin, with AutoIncrements
+	MarkerID int64  `json:"marker_id,omitempty"`
+	Pos      string `json:"pos,omitempty"`
+	GTIDSet  string `json:"gtid_set,omitempty"`
+
+	Entry *rollbackEntry `json:"entry,omitempty"`
+	Done  []string       `json:"done,omitempty"` // positions of the changes rolled back or discarded
+}
+
+// openJournal creates the journal at path, it refuses to overwrite a journal with outstanding
+// entries, which are left by a crashed process and must be recovered first
+func (s *Session) openJournal(path string) (*journal, error) {
+	if _, entries, err := readJournal(path); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("journal %s has %d outstanding rollback entries of a previous run, recover them with RecoverAndRollback first", path, len(entries))
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal %s, err=%s", path, err.Error())
+	}
+	j := &journal{path: path, f: f, outstanding: map[string]int{}}
+
+	header := journalRecord{Type: journalSession, Host: s.conf.Host, Port: s.conf.Port, User: s.conf.User, AutoIncrements: s.autoIncrements()}
+	if err := j.write(header); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	logrus.Infof("rollback journal is written to %s", path)
+	return j, nil
+}
+
+// autoIncrements returns the auto increment ids of the loaded tables, db.table => id
+func (s *Session) autoIncrements() map[string]uint64 {
+	autoIncrements := map[string]uint64{}
+	for key, tbInfo := range s.tableinfo.tables() {
+		if tbInfo != nil {
+			autoIncrements[key] = tbInfo.AutoIncrement
+		}
+	}
+	return autoIncrements
+}
+
+// write appends rec, the caller must hold mu unless the journal is not shared yet
+func (j *journal) write(rec journalRecord) error {
+	rec.Time = time.Now()
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// no buffering, a killed process must not lose what is written
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal %s, err=%s", j.path, err.Error())
+	}
+	return nil
+}
+
+// appendEntries records the rollback entries of sqls generated for the change src
+func (j *journal) appendEntries(sqls []string, src rollbackEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, sql := range sqls {
+		entry := src
+		entry.MarkerID = -1
+		entry.SQL = sql
+		if err := j.write(journalRecord{Type: journalEntry, Entry: &entry}); err != nil {
+			return err
+		}
+		j.outstanding[entry.Pos]++
+	}
+	return nil
+}
+
+// begin records the start of a rollback cycle with the auto increment ids to reset to,
+// the entries collected before it are discarded
+func (j *journal) begin(markerID int64, pos string, gtidSet string, autoIncrements map[string]uint64, discarded []rollbackEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.markDone(discarded); err != nil {
+		return err
+	}
+	return j.write(journalRecord{Type: journalBegin, MarkerID: markerID, Pos: pos, GTIDSet: gtidSet, AutoIncrements: autoIncrements})
+}
+
+// done records that entries are rolled back
+func (j *journal) done(entries []rollbackEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.markDone(entries)
+}
+
+func (j *journal) markDone(entries []rollbackEntry) error {
+	var positions []string
+	seen := map[string]struct{}{}
+	for _, entry := range entries {
+		if _, ok := seen[entry.Pos]; ok {
+			continue
+		}
+		seen[entry.Pos] = struct{}{}
+		positions = append(positions, entry.Pos)
+	}
+	if len(positions) == 0 {
+		return nil
+	}
+	if err := j.write(journalRecord{Type: journalDone, Done: positions}); err != nil {
+		return err
+	}
+	for _, pos := range positions {
+		delete(j.outstanding, pos)
+	}
+	return nil
+}
+
+// close closes the journal and removes it if nothing is left to roll back
+func (j *journal) close() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.f.Close(); err != nil {
+		logrus.Errorf("failed to close journal %s, err=%s", j.path, err.Error())
+	}
+	if len(j.outstanding) > 0 {
+		logrus.Warnf("journal %s is kept, %d changes are not rolled back", j.path, len(j.outstanding))
+		return
+	}
+	if err := os.Remove(j.path); err != nil {
+		logrus.Errorf("failed to remove journal %s, err=%s", j.path, err.Error())
+	}
+}
+
+// readJournal returns the session header and the outstanding entries of the journal at path in binlog order.
+// The AutoIncrements of the header are the ones of the last cycle begun.
+// A truncated last line, written when the process is killed, is ignored.
+func readJournal(path string) (journalRecord, []rollbackEntry, error) {
+	var header journalRecord
+	f, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer f.Close()
+
+	var entries []rollbackEntry
+	done := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			logrus.Warnf("skipping broken line %d of journal %s, err=%s", line, path, err.Error())
+			continue
+		}
+		switch rec.Type {
+		case journalSession:
+			header = rec
+		case journalBegin:
+			if rec.AutoIncrements != nil {
+				header.AutoIncrements = rec.AutoIncrements
+			}
+		case journalEntry:
+			if rec.Entry != nil {
+				entries = append(entries, *rec.Entry)
+			}
+		case journalDone:
+			for _, pos := range rec.Done {
+				done[pos] = struct{}{}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return header, nil, fmt.Errorf("failed to read journal %s, err=%s", path, err.Error())
+	}
+
+	outstanding := entries[:0]
+	for _, entry := range entries {
+		if _, ok := done[entry.Pos]; !ok {
+			outstanding = append(outstanding, entry)
+		}
+	}
+	return header, outstanding, nil
+}
+
+// RecoverAndRollback rolls back the changes left in the journal of a crashed process, see WithJournal.
+// It connects to the server recorded in the journal with password, and removes the journal on success.
+// DDL which can not be reverted, and tables truncated or dropped whose rows are not in the binlog,
+// are reported by an *IrreversibleDDLError once the rest is rolled back, the journal is removed then too.
+func RecoverAndRollback(journalPath string, password string) error {
+	return RecoverAndRollbackContext(context.Background(), journalPath, password)
+}
+
+// RecoverAndRollbackContext is RecoverAndRollback with a context to bound the execution of rollback SQLs.
+func RecoverAndRollbackContext(ctx context.Context, journalPath string, password string) error {
+	header, entries, err := readJournal(journalPath)
+	if err != nil {
+		return fmt.Errorf("failed to read journal %s, err=%w", journalPath, err)
+	}
+	if header.Type != journalSession {
+		return fmt.Errorf("journal %s has no session header", journalPath)
+	}
+
+	var execErr error
+	if len(entries) > 0 {
+		s := &Session{conf: newConfCmd(header.Host, header.Port, header.User, password)}
+		defer func() {
+			if s.sqlCon != nil {
+				_ = s.sqlCon.Close()
+			}
+		}()
+		tableInfos := map[string]*tblInfoJson{}
+		for key, autoIncrement := range header.AutoIncrements {
+			tableInfos[key] = &tblInfoJson{AutoIncrement: autoIncrement}
+		}
+		s.tableinfo.replace(tableInfos, mysql.Position{})
+
+		// the shadow snapshots are not recorded, the rows of the wiped tables can not be restored
+		for i := range entries {
+			if entries[i].Wiped {
+				entries[i].Wiped = false
+				entries[i].Irreversible = fmt.Sprintf("rows of %s removed by it are not in the binlog, recovery can not restore them", getTableName(entries[i].DB, entries[i].Table))
+			}
+		}
+
+		logrus.Infof("rolling back %d outstanding entries of journal %s on MySQL server %s:%d", len(entries), journalPath, header.Host, header.Port)
+		if execErr = s.execRollback(ctx, 0, entries, false); !isIrreversible(execErr) {
+			return execErr
+		}
+	} else {
+		logrus.Infof("nothing to roll back in journal %s", journalPath)
+	}
+
+	if err := os.Remove(journalPath); err != nil {
+		return fmt.Errorf("rolled back, but failed to remove journal %s, err=%s", journalPath, err.Error())
+	}
+	return execErr
+}
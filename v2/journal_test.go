@@ -0,0 +1,93 @@
+package mysqlbinlog
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mysqlbinlog.journal")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &journal{path: path, f: f, outstanding: map[string]int{}}
+	write := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(j.write(journalRecord{Type: journalSession, Host: "db", Port: 3306, User: "root", AutoIncrements: map[string]uint64{"shop.orders": 10}}))
+	discarded := rollbackEntry{DB: "shop", Table: "orders", Pos: "binlog.000001 100-200", SqlType: SQLTypeInsert}
+	write(j.appendEntries([]string{"DELETE FROM `shop`.`orders` WHERE `id`=10"}, discarded))
+	write(j.begin(1, "binlog.000001 300", "", map[string]uint64{"shop.orders": 11, "shop.items": 5}, []rollbackEntry{discarded}))
+
+	inserted := rollbackEntry{DB: "shop", Table: "orders", Pos: "binlog.000001 400-500", SqlType: SQLTypeInsert}
+	write(j.appendEntries([]string{"DELETE FROM `shop`.`orders` WHERE `id`=11", "DELETE FROM `shop`.`orders` WHERE `id`=12"}, inserted))
+	rolledBack := rollbackEntry{DB: "shop", Table: "items", Pos: "binlog.000001 600-700", SqlType: SQLTypeUpdate}
+	write(j.appendEntries([]string{"UPDATE `shop`.`items` SET `n`=1 WHERE `id`=1"}, rolledBack))
+	write(j.done([]rollbackEntry{rolledBack}))
+	irreversible := rollbackEntry{DB: "shop", Table: "v", Pos: "binlog.000001 800-900", Query: "DROP VIEW v", SqlType: SQLTypeDDL, Irreversible: "views are not tracked"}
+	write(j.appendEntries([]string{""}, irreversible))
+	wiped := rollbackEntry{DB: "shop", Table: "items", Pos: "binlog.000001 1000-1100", Query: "TRUNCATE items", SqlType: SQLTypeDDL, Wiped: true}
+	write(j.appendEntries([]string{""}, wiped))
+	// killed while writing the next entry
+	if _, err := f.WriteString(`{"type":"entry","time":"2024-05-01T12:00:00Z","entry":{"MarkerID":-1,"SQL":"DELETE`); err != nil {
+		t.Fatal(err)
+	}
+	write(f.Close())
+
+	header, entries, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("readJournal: %s", err)
+	}
+	if header.Type != journalSession || header.Host != "db" || header.Port != 3306 || header.User != "root" {
+		t.Errorf("header %+v, want the session of db:3306 as root", header)
+	}
+	if want := map[string]uint64{"shop.orders": 11, "shop.items": 5}; !reflect.DeepEqual(header.AutoIncrements, want) {
+		t.Errorf("auto increments %v, want %v of the last begin", header.AutoIncrements, want)
+	}
+
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Pos+" "+entry.SQL)
+		if entry.MarkerID != -1 {
+			t.Errorf("entry at %s has marker id %d, want -1", entry.Pos, entry.MarkerID)
+		}
+	}
+	want := []string{
+		"binlog.000001 400-500 DELETE FROM `shop`.`orders` WHERE `id`=11",
+		"binlog.000001 400-500 DELETE FROM `shop`.`orders` WHERE `id`=12",
+		"binlog.000001 800-900 ",
+		"binlog.000001 1000-1100 ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("outstanding entries %q, want %q", got, want)
+	}
+	if entries[2].Irreversible != irreversible.Irreversible || !entries[3].Wiped {
+		t.Errorf("irreversible %q and wiped %t entries are not kept as written", entries[2].Irreversible, entries[3].Wiped)
+	}
+}
+
+func TestReadJournalWithoutBegin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mysqlbinlog.journal")
+	content := `{"type":"session","time":"2024-05-01T12:00:00Z","host":"db","port":3306,"user":"root","auto_increments":{"shop.orders":10}}` + "\n" +
+		`{"type":"entry","time":"2024-05-01T12:00:01Z","entry":{"MarkerID":-1,"SQL":"DELETE FROM t","DB":"shop","Table":"orders","Pos":"binlog.000001 100-200"}}` + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	header, entries, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("readJournal: %s", err)
+	}
+	if header.AutoIncrements["shop.orders"] != 10 {
+		t.Errorf("auto increments %v, want the ones of the session header", header.AutoIncrements)
+	}
+	if len(entries) != 1 || entries[0].SQL != "DELETE FROM t" {
+		t.Errorf("outstanding entries %+v, want the DELETE", entries)
+	}
+}
@@ -1,93 +1,286 @@
 package mysqlbinlog
 
 import (
-	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/pingcap/parser/ast"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
 	"github.com/sirupsen/logrus"
 )
 
-var eventChan = make(chan myBinEvent, 100)
-
-func startListenBinEvents(pos mysql.Position) {
-	defer close(eventChan)
-	replStreamer := newBinlogStreamer(pos)
-	sendBinlogEvent(replStreamer, eventChan)
+func (s *Session) startListenBinEvents(replStreamer *replication.BinlogStreamer, pos mysql.Position) {
+	defer s.wg.Done()
+	defer close(s.eventChan)
+	if err := s.sendBinlogEvent(replStreamer, pos, s.eventChan); err != nil {
+		s.setErr(err)
+	}
 }
 
-func newBinlogStreamer(pos mysql.Position) *replication.BinlogStreamer {
+func (s *Session) newBinlogStreamer(pos mysql.Position) (*replication.BinlogStreamer, error) {
 	replCfg := replication.BinlogSyncerConfig{
-		ServerID:                1113306,
-		Flavor:                  "mysql",
-		Host:                    confCmd.Host,
-		Port:                    uint16(confCmd.Port),
-		User:                    confCmd.User,
-		Password:                confCmd.Passwd,
-		Charset:                 "utf8",
+		ServerID:                s.conf.ServerID,
+		Flavor:                  s.conf.Flavor,
+		Host:                    s.conf.Host,
+		Port:                    uint16(s.conf.Port),
+		User:                    s.conf.User,
+		Password:                s.conf.Passwd,
+		Charset:                 s.conf.Charset,
+		HeartbeatPeriod:         s.conf.HeartbeatPeriod,
+		ReadTimeout:             s.conf.ReadTimeout,
 		SemiSyncEnabled:         false,
-		TimestampStringLocation: confCmd.BinlogTimeLocation,
+		TimestampStringLocation: s.conf.BinlogTimeLocation,
 		ParseTime:               false, // do not parse mysql datetime/time column into go time structure, take it as string
-		UseDecimal:              false, // sqlbuilder not support decimal type
+		UseDecimal:              true,  // DECIMAL as decimal.Decimal, a float64 loses digits, see literal
+		DisableRetrySync:        true,  // the library resumes from the middle of a transaction, reconnect handles it instead
 	}
 
 	replSyncer := replication.NewBinlogSyncer(replCfg)
+	s.syncer = replSyncer
 
-	replStreamer, err := replSyncer.StartSync(pos)
+	var replStreamer *replication.BinlogStreamer
+	var err error
+	if s.conf.GTID {
+		gset := s.cloneGTIDSet()
+		logrus.Infof("start to sync binlog from GTID set %s, server id=%d, flavor=%s", gset.String(), s.conf.ServerID, s.conf.Flavor)
+		replStreamer, err = replSyncer.StartSyncGTID(gset)
+	} else {
+		logrus.Infof("start to sync binlog from %s, server id=%d, flavor=%s", pos.String(), s.conf.ServerID, s.conf.Flavor)
+		replStreamer, err = replSyncer.StartSync(pos)
+	}
 	if err != nil {
-		logrus.Panicf("error replication from master %s:%d ", confCmd.Host, confCmd.Port)
+		return nil, fmt.Errorf("error replication from master %s:%d, err=%s", s.conf.Host, s.conf.Port, err.Error())
 	}
-	return replStreamer
+	return replStreamer, nil
 }
 
-func sendBinlogEvent(streamer *replication.BinlogStreamer, eventChan chan myBinEvent) {
+func (s *Session) sendBinlogEvent(streamer *replication.BinlogStreamer, pos mysql.Position, eventChan chan myBinEvent) error {
 	logrus.Info("start to get binlog from mysql")
 
-	var (
-		chkRe         int
-		currentBinlog = confCmd.StartFile
-		sqlType       SQLType
-		tbMapPos      uint32 = 0
-	)
-
+	tracker := &eventTracker{session: s, currentBinlog: pos.Name, resumePos: pos}
 	for {
-		ev, err := streamer.GetEvent(context.Background())
+		ev, err := streamer.GetEvent(s.ctx)
 		if err != nil {
-			logrus.Panicf("error to get binlog event, err=%s", err)
+			if s.ctx.Err() != nil {
+				// stopped by Stop
+				return nil
+			}
+			if streamer, err = s.reconnect(tracker, err); err != nil {
+				return err
+			}
+			continue
 		}
 
-		if ev.Header.EventType == replication.TABLE_MAP_EVENT {
-			tbMapPos = ev.Header.LogPos - ev.Header.EventSize // avoid mysqlbing mask the row event as unknown table row event
+		oneMyEvent, err := tracker.track(ev)
+		if err != nil {
+			return err
 		}
+		if oneMyEvent == nil {
+			continue
+		}
+		// a reconnect resumes from the last transaction boundary, the rows events already sent come again
+		if tracker.lastSent.Name != "" && oneMyEvent.MyPos.Compare(tracker.lastSent) <= 0 {
+			continue
+		}
+		tracker.lastSent = oneMyEvent.MyPos
+		select {
+		case eventChan <- *oneMyEvent:
+		case <-s.done:
+			// the generator has stopped, nobody will consume the event
+			return nil
+		case <-s.ctx.Done():
+			return nil
+		}
+	}
+}
 
-		ev.RawData = []byte{} // remove useless info
-		oneMyEvent := &myBinEvent{MyPos: mysql.Position{Name: currentBinlog, Pos: ev.Header.LogPos}, StartPos: tbMapPos}
+// reconnect closes the broken binlog stream and starts a new one from the last transaction boundary,
+// retrying with backoff until it succeeds, the attempts run out or the session is stopped
+func (s *Session) reconnect(tracker *eventTracker, cause error) (*replication.BinlogStreamer, error) {
+	if s.conf.MaxReconnectAttempts <= 0 {
+		return nil, fmt.Errorf("error to get binlog event, err=%s", cause)
+	}
+	backoff := s.conf.ReconnectMinBackoff
+	for attempt := 1; attempt <= s.conf.MaxReconnectAttempts; attempt++ {
+		if s.syncer != nil {
+			s.syncer.Close()
+			s.syncer = nil
+		}
+		info := ReconnectInfo{Attempt: attempt, Pos: tracker.resumePos, GTIDSet: s.LastGTIDSet(), Err: cause}
+		logrus.Warnf("binlog stream of MySQL server %s:%d broke, reconnecting in %s, attempt %d/%d, resume position %s, err=%s",
+			s.conf.Host, s.conf.Port, backoff, attempt, s.conf.MaxReconnectAttempts, info.Pos.String(), cause.Error())
+		if s.conf.OnReconnect != nil {
+			s.conf.OnReconnect(info)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+			return nil, fmt.Errorf("stopped while reconnecting, err=%s", cause)
+		}
+		if backoff *= 2; backoff > s.conf.ReconnectMaxBackoff {
+			backoff = s.conf.ReconnectMaxBackoff
+		}
 
-		chkRe = oneMyEvent.checkBinEvent(confCmd, ev, &currentBinlog)
-		if chkRe == CRecontinue || chkRe == CRefileend {
+		streamer, err := s.newBinlogStreamer(tracker.resumePos)
+		if err != nil {
+			cause = err
 			continue
 		}
+		atomic.AddInt64(&s.reconnects, 1)
+		logrus.Infof("binlog stream of MySQL server %s:%d resumed from %s", s.conf.Host, s.conf.Port, tracker.resumePos.String())
+		return streamer, nil
+	}
+	return nil, fmt.Errorf("gave up reconnecting after %d attempts, err=%s", s.conf.MaxReconnectAttempts, cause)
+}
 
-		if chkRe == CReprocess {
-			sqlType = getSqlType(ev)
-			if oneMyEvent.IfRowsEvent {
-				tbKey := getTableName(string(oneMyEvent.BinEvent.Table.Schema), string(oneMyEvent.BinEvent.Table.Table))
-				if shouldSkipTable(tbKey) {
-					logrus.Infof("skipping binlog event for table %v", tbKey)
-					continue
-				}
-				if _, ok := tableinfo.tableInfos[tbKey]; !ok {
-					logrus.Infof("no table struct found for %s, it maybe dropped, skip it. RowsEvent position:%s", tbKey, oneMyEvent.MyPos.String())
-					continue
+// Reconnects returns how many times the binlog stream is resumed after it broke.
+func (s *Session) Reconnects() int64 {
+	return atomic.LoadInt64(&s.reconnects)
+}
+
+// eventTracker follows the binlog event by event, it keeps the context of the current transaction
+// and turns the rows events into myBinEvents for the generator
+type eventTracker struct {
+	session       *Session
+	currentBinlog string
+	tbMapPos      uint32
+	threadID      uint32
+	gtid          string
+	query         string // statement of the following rows events, if the server annotates them
+
+	offline   bool           // parsing binlog files, the server does not tell the table definitions of the events
+	resumePos mysql.Position // end of the last committed transaction, where a reconnect resumes from
+	lastSent  mysql.Position // position of the last rows event sent to the generator
+
+	// MariaDB events compressed by log_bin_compress are decoded again once inflated, see uncompressEvent
+	format *replication.FormatDescriptionEvent
+	parser *replication.BinlogParser
+}
+
+// commit marks the end of the current transaction
+func (t *eventTracker) commit(logPos uint32) error {
+	t.resumePos = mysql.Position{Name: t.currentBinlog, Pos: logPos}
+	if t.gtid == "" {
+		return nil
+	}
+	gtid := t.gtid
+	t.gtid = ""
+	if err := t.session.addGTID(gtid); err != nil {
+		return fmt.Errorf("failed to add GTID %s to the executed set, err=%s", gtid, err.Error())
+	}
+	return nil
+}
+
+// track returns the myBinEvent of ev, nil if ev is not a rows event to generate rollback SQLs for
+func (t *eventTracker) track(ev *replication.BinlogEvent) (*myBinEvent, error) {
+	s := t.session
+	if s.conf.Flavor == mysql.MariaDBFlavor {
+		var err error
+		if ev, err = t.uncompressEvent(ev); err != nil {
+			return nil, err
+		}
+	}
+	if ev.Header.EventType == replication.TABLE_MAP_EVENT {
+		t.tbMapPos = ev.Header.LogPos - ev.Header.EventSize // avoid mysqlbing mask the row event as unknown table row event
+	}
+	switch ev.Header.EventType {
+	case replication.QUERY_EVENT:
+		// "BEGIN" of a transaction carries the id of the connection which writes the following row events
+		queryEv := ev.Event.(*replication.QueryEvent)
+		t.threadID = queryEv.SlaveProxyID
+		t.query = ""
+		// any other query, DDL or the COMMIT of a non-transactional table, ends a transaction
+		if !strings.EqualFold(strings.TrimSpace(string(queryEv.Query)), "BEGIN") {
+			gtid := t.gtid
+			if err := t.commit(ev.Header.LogPos); err != nil {
+				return nil, err
+			}
+			// rows events after a DDL are decoded with the table structures it leaves
+			ddlPos := mysql.Position{Name: t.currentBinlog, Pos: ev.Header.LogPos}
+			stmts, err := s.tableinfo.applyDDL(ddlPos, string(queryEv.Schema), string(queryEv.Query))
+			if err != nil {
+				// the generator still reloads the table structures when the columns do not match
+				logrus.Infof("Warning: %s", err.Error())
+			}
+			// the marker and shadow databases are created and dropped by the sessions themselves
+			if (s.conf.DDLRollback || s.conf.Shadow) && (len(stmts) > 0 || err != nil) && !isSessionSchemaQuery(string(queryEv.Query)) {
+				startPos := ev.Header.LogPos - ev.Header.EventSize
+				if s.conf.DDLRollback {
+					s.trackDefinitions(ddlPos, startPos, string(queryEv.Schema), string(queryEv.Query), stmts, !t.offline)
 				}
+				s.setLastPos(ddlPos)
+				return &myBinEvent{MyPos: ddlPos, StartPos: startPos, ThreadID: t.threadID, GTID: gtid,
+					Query: string(queryEv.Query), SqlType: SQLTypeDDL, DDL: &ddlEvent{Schema: string(queryEv.Schema), Stmts: stmts, Err: err}}, nil
 			}
+		}
+	case replication.XID_EVENT:
+		if err := t.commit(ev.Header.LogPos); err != nil {
+			return nil, err
+		}
+	case replication.GTID_EVENT:
+		t.gtid = formatGTID(ev.Event.(*replication.GTIDEvent))
+	case replication.MARIADB_GTID_EVENT:
+		// MariaDB starts a transaction with the GTID event instead of a "BEGIN" query,
+		// which does not carry the connection id, so its changes can not be attributed to scopes
+		gtidEv := ev.Event.(*replication.MariadbGTIDEvent)
+		t.gtid = gtidEv.GTID.String()
+		t.threadID = 0
+		t.query = ""
+	case replication.ROTATE_EVENT:
+		rotateEv := ev.Event.(*replication.RotateEvent)
+		t.resumePos = mysql.Position{Name: string(rotateEv.NextLogName), Pos: uint32(rotateEv.Position)}
+	case replication.ROWS_QUERY_EVENT:
+		t.query = string(ev.Event.(*replication.RowsQueryEvent).Query)
+	case replication.MARIADB_ANNOTATE_ROWS_EVENT:
+		t.query = string(ev.Event.(*replication.MariadbAnnotateRowsEvent).Query)
+	}
+
+	ev.RawData = []byte{} // remove useless info
+	oneMyEvent := &myBinEvent{MyPos: mysql.Position{Name: t.currentBinlog, Pos: ev.Header.LogPos}, StartPos: t.tbMapPos, ThreadID: t.threadID, GTID: t.gtid, Query: t.query}
+	if ev.Header.LogPos > 0 {
+		s.setLastPos(oneMyEvent.MyPos)
+	}
+
+	chkRe := oneMyEvent.checkBinEvent(s.conf, ev, &t.currentBinlog)
+	if chkRe == CRecontinue || chkRe == CRefileend {
+		return nil, nil
+	}
+
+	if chkRe != CReprocess {
+		logrus.Infof("this should not happen: return value of CheckBinEvent() is %d\n", chkRe)
+		return nil, nil
+	}
 
-			oneMyEvent.SqlType = sqlType
-			eventChan <- *oneMyEvent
-		} else {
-			logrus.Infof("this should not happen: return value of CheckBinEvent() is %d\n", chkRe)
+	if oneMyEvent.IfRowsEvent {
+		if string(oneMyEvent.BinEvent.Table.Schema) == shadowDatabaseName {
+			return nil, nil
+		}
+		tbKey := getTableName(string(oneMyEvent.BinEvent.Table.Schema), string(oneMyEvent.BinEvent.Table.Table))
+		if shouldSkipTable(tbKey) {
+			logrus.Infof("skipping binlog event for table %v", tbKey)
+			return nil, nil
+		}
+		// with binlog_row_metadata=FULL the event describes its columns itself
+		if _, ok := s.tableinfo.lookup(tbKey, oneMyEvent.MyPos); !ok && len(oneMyEvent.BinEvent.Table.ColumnName) == 0 {
+			logrus.Infof("no table struct found for %s, it maybe dropped, skip it. RowsEvent position:%s", tbKey, oneMyEvent.MyPos.String())
+			return nil, nil
+		}
+		// the definition before a later DDL on the table, while no DDL is in between
+		if s.conf.DDLRollback && !t.offline && tbKey != markerDatabaseTableFullName && !s.definitions.current(tbKey) {
+			s.captureDefinition(string(oneMyEvent.BinEvent.Table.Schema), string(oneMyEvent.BinEvent.Table.Table))
 		}
 	}
+	oneMyEvent.SqlType = getSqlType(ev)
+	return oneMyEvent, nil
+}
+
+// isSessionSchemaQuery tells if query is about the marker or shadow database of the sessions
+func isSessionSchemaQuery(query string) bool {
+	return strings.Contains(query, markerDatabaseName) || strings.Contains(query, shadowDatabaseName)
 }
 
 type myBinEvent struct {
@@ -95,7 +288,27 @@ type myBinEvent struct {
 	BinEvent    *replication.RowsEvent
 	StartPos    uint32 // this is the start position
 	IfRowsEvent bool
-	SqlType     SQLType // insert, update, delete
+	SqlType     SQLType   // insert, update, delete
+	ThreadID    uint32    // id of the connection which made the change
+	GTID        string    // GTID of the transaction, empty without gtid_mode
+	Query       string    // statement which made the change, set if binlog_rows_query_log_events or binlog_annotate_row_events is on
+	DDL         *ddlEvent // set for a DDL query with WithDDLRollback, Query is the DDL then
+}
+
+// ddlEvent is a DDL sent to the generator to revert it
+type ddlEvent struct {
+	Schema string // default database of the query
+	Stmts  []ast.StmtNode
+	Err    error // the query can not be parsed
+}
+
+// formatGTID returns the GTID of ev as uuid:gno
+func formatGTID(ev *replication.GTIDEvent) string {
+	sid := ev.SID
+	if len(sid) != 16 {
+		return fmt.Sprintf("%x:%d", sid, ev.GNO)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x:%d", sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16], ev.GNO)
 }
 
 func (s *myBinEvent) checkBinEvent(cfg *ConfCmd, ev *replication.BinlogEvent, currentBinlog *string) int {
@@ -1,32 +1,85 @@
 package mysqlbinlog
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/sirupsen/logrus"
 )
 
-func getCurrentPosition() (pos mysql.Position, err error) {
-	con := getDBCon()
-	var res [5]string
-	if err := con.QueryRow(showMasterStatusSQL).Scan(&res[0], &res[1], &res[2], &res[3], &res[4]); err != nil {
-		return pos, err
+// getCurrentPosition returns the current binlog position and the executed GTID set, the latter is empty without GTIDs
+func (s *Session) getCurrentPosition() (pos mysql.Position, gtidSet string, err error) {
+	con, err := s.getDBCon()
+	if err != nil {
+		return pos, "", err
+	}
+	// MySQL returns 5 columns and MariaDB 4 without Executed_Gtid_Set, so pick them by name
+	status, err := queryRowByName(con, s.version.binlogStatusSQL())
+	if err != nil {
+		return pos, "", err
+	}
+	if status["File"] == "" {
+		return pos, "", fmt.Errorf("binlog is not enabled")
+	}
+	p, err := strconv.Atoi(status["Position"])
+	if err != nil {
+		return pos, "", err
 	}
-	p, err := strconv.Atoi(res[1])
+	pos = mysql.Position{Name: status["File"], Pos: uint32(p)}
+
+	if s.conf.Flavor == mysql.MariaDBFlavor {
+		if err := con.QueryRow(mariadbGTIDPosSQL).Scan(&gtidSet); err != nil {
+			return pos, "", err
+		}
+		return pos, strings.TrimSpace(gtidSet), nil
+	}
+	// MySQL breaks long GTID sets into lines
+	gtidSet = strings.ReplaceAll(strings.TrimSpace(status["Executed_Gtid_Set"]), "\n", "")
+	return pos, gtidSet, nil
+}
+
+// queryRowByName returns the first row of query as column name => value, NULL is read as empty
+func queryRowByName(con *sql.DB, query string) (map[string]string, error) {
+	rows, err := con.Query(query)
 	if err != nil {
-		return pos, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	return mysql.Position{Name: res[0], Pos: uint32(p)}, nil
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(columns))
+	for i, col := range columns {
+		res[col] = values[i].String
+	}
+	return res, nil
 }
 
-func mysqlUrl() string {
+func (s *Session) mysqlUrl() string {
 	return fmt.Sprintf(
 		"%s:%s@tcp(%s:%d)/?autocommit=true&charset=utf8mb4,utf8,latin1&loc=Local&parseTime=true&multiStatements=true",
-		confCmd.User, confCmd.Passwd, confCmd.Host, confCmd.Port)
+		s.conf.User, s.conf.Passwd, s.conf.Host, s.conf.Port)
 }
 
 func connectMysql(mysqlUrl string) (*sql.DB, error) {
@@ -48,30 +101,35 @@ func connectMysql(mysqlUrl string) (*sql.DB, error) {
 	return db, nil
 }
 
-var sqlCon *sql.DB
-
-func getDBCon() *sql.DB {
-	if sqlCon != nil {
-		return sqlCon
+func (s *Session) getDBCon() (*sql.DB, error) {
+	if s.sqlCon != nil {
+		return s.sqlCon, nil
 	}
-	con, err := connectMysql(mysqlUrl())
+	con, err := connectMysql(s.mysqlUrl())
 	if err != nil {
-		logrus.Panicf("fail to connect to mysql, err=%s", err.Error())
+		return nil, fmt.Errorf("fail to connect to mysql, err=%s", err.Error())
+	}
+	if s.schemaOnly {
+		// Flashback and SaveSchemaSnapshot must not need the privilege to disable binlog
+		s.sqlCon = con
+		return s.sqlCon, nil
 	}
 
 	if _, err := con.Exec(disableBinlogSQL); err != nil {
-		logrus.Panicf("failed to disable binlog, err=%s", err.Error())
+		_ = con.Close()
+		return nil, fmt.Errorf("failed to disable binlog, err=%s", err.Error())
 	}
 
 	if _, err := con.Exec(disableKeyCheckSQL); err != nil {
-		logrus.Panicf("failed to disable foreign key check, err=%s", err.Error())
+		_ = con.Close()
+		return nil, fmt.Errorf("failed to disable foreign key check, err=%s", err.Error())
 	}
 
-	sqlCon = con
-	return sqlCon
+	s.sqlCon = con
+	return s.sqlCon, nil
 }
 
-func getTableNames() (map[string][]string, error) {
+func (s *Session) getTableNames() (map[string][]string, error) {
 	logrus.Info("getting target table names from mysql")
 
 	var (
@@ -80,7 +138,12 @@ func getTableNames() (map[string][]string, error) {
 		dbTables = map[string][]string{}
 	)
 
-	rows, err := getDBCon().Query(getTableNamesSQL)
+	con, err := s.getDBCon()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := con.Query(getTableNamesSQL)
 	if err != nil {
 		return nil, err
 	}
@@ -92,6 +155,9 @@ func getTableNames() (map[string][]string, error) {
 		if err = rows.Scan(&schema, &table); err != nil {
 			return nil, err
 		}
+		if schema == shadowDatabaseName {
+			continue
+		}
 		if _, ok := dbTables[schema]; ok {
 			dbTables[schema] = append(dbTables[schema], table)
 		} else {
@@ -101,82 +167,111 @@ func getTableNames() (map[string][]string, error) {
 	return dbTables, nil
 }
 
-func getTableInfo() error {
+// getTableInfo reloads the table structures, consumed is the position of the last event the generator handled
+func (s *Session) getTableInfo(consumed mysql.Position) error {
+	if s.conf.SchemaFile != "" {
+		return s.loadSchemaSnapshot(s.conf.SchemaFile)
+	}
 	logrus.Info("start to get table structure from mysql")
 
-	allTables, err := getTableNames()
+	con, err := s.getDBCon()
+	if err != nil {
+		return err
+	}
+
+	allTables, err := s.getTableNames()
 	if err != nil {
 		return fmt.Errorf("failed to get table names, err=%s", err.Error())
 	}
 
-	if err = tableinfo.getTableFields(allTables, 5000); err != nil {
+	// loaded aside, the listener and the generator keep reading the current ones meanwhile
+	loaded := &tablesColumnsInfo{}
+	if err = loaded.getTableFields(con, allTables, 5000); err != nil {
 		return fmt.Errorf("failed to get table fields, err=%s", err.Error())
 	}
 
-	if err = tableinfo.getTableKeys(allTables, 5000); err != nil {
+	if err = loaded.getTableKeys(con, allTables, 5000); err != nil {
 		return fmt.Errorf("failed to get table keys, err=%s", err.Error())
 	}
 
-	if err = tableinfo.getTableAutoIncrements(allTables, 5000); err != nil {
+	if err = loaded.getTableAutoIncrements(con, allTables, 5000); err != nil {
 		return fmt.Errorf("failed to get table auto_increments, err=%s", err.Error())
 	}
 
-	if len(tableinfo.tableInfos) == 0 {
-		return fmt.Errorf("get no table difinition info from mysql, pls check user %s has privileges to read tables in infomation_schema", confCmd.User)
+	if len(loaded.tableInfos) == 0 {
+		return fmt.Errorf("get no table difinition info from mysql, pls check user %s has privileges to read tables in infomation_schema", s.conf.User)
 	}
 
+	s.tableinfo.replace(loaded.tableInfos, consumed)
 	logrus.Info("successfully get table infos from db")
 	return nil
 }
 
-func dropMarkerDB() error {
-	// Drop marker database
-	con := getDBCon()
-	_, err := con.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s;", markerDatabaseName))
+// removeMarkers deletes the marker rows of the session, the marker database is shared with other sessions
+func (s *Session) removeMarkers() error {
+	con, err := s.getDBCon()
 	if err != nil {
-		return fmt.Errorf("failed to drop marker database: %s", err.Error())
+		return err
 	}
-	logrus.Infof("Marker database %s dropped successfully", markerDatabaseName)
+	_, err = con.Exec(fmt.Sprintf("DELETE FROM %s WHERE session = ?;", markerDatabaseTableFullName), s.markerSession)
+	if err != nil {
+		return fmt.Errorf("failed to remove markers: %s", err.Error())
+	}
+	logrus.Infof("Markers of session %s removed successfully", s.markerSession)
 	return nil
 }
 
-var markerSqlCon *sql.DB
-
 // binglog is enabled, used to manipulate marker database to add markers
-func getMarkerDBCon() *sql.DB {
-	if markerSqlCon != nil {
-		return markerSqlCon
+func (s *Session) getMarkerDBCon() (*sql.DB, error) {
+	if s.markerSqlCon != nil {
+		return s.markerSqlCon, nil
 	}
-	con, err := connectMysql(mysqlUrl())
+	con, err := connectMysql(s.mysqlUrl())
 	if err != nil {
-		logrus.Panicf("fail to connect to mysql, err=%s", err.Error())
+		return nil, fmt.Errorf("fail to connect to mysql, err=%s", err.Error())
 	}
-	markerSqlCon = con
-	return markerSqlCon
+	s.markerSqlCon = con
+	return s.markerSqlCon, nil
 }
 
-func initMarkerDB() error {
-	// Create marker database and table if not exists
-	con := getDBCon()
-
-	// Drop existing database if exists
-	_, err := con.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s;", markerDatabaseName))
+// initMarkerDB creates the marker database and table if not exists, they are shared by the sessions
+// of all processes on the server, each session tells its own markers by the session column
+func (s *Session) initMarkerDB() error {
+	con, err := s.getDBCon()
 	if err != nil {
-		return fmt.Errorf("failed to drop existing marker database: %s", err.Error())
+		return err
 	}
 
-	// Create new database
-	_, err = con.Exec(fmt.Sprintf("CREATE DATABASE %s;", markerDatabaseName))
+	_, err = con.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s;", markerDatabaseName))
 	if err != nil {
 		return fmt.Errorf("failed to create marker database: %s", err.Error())
 	}
 
-	// Create marker table
-	_, err = con.Exec(fmt.Sprintf(`CREATE TABLE %s.marker (
-		id BIGINT AUTO_INCREMENT PRIMARY KEY
-	);`, markerDatabaseName))
+	_, err = con.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		session VARCHAR(64) NOT NULL
+	);`, markerDatabaseTableFullName))
 	if err != nil {
 		return fmt.Errorf("failed to create marker table: %s", err.Error())
 	}
 	return nil
 }
+
+// newMarkerSession returns a random id telling the markers of a session from the ones of other sessions
+func newMarkerSession() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session id, err=%s", err.Error())
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ownMarker returns the id of a row inserted into the marker table, ok is false if another session inserted it
+func (s *Session) ownMarker(row []interface{}) (id int64, ok bool) {
+	if len(row) < 2 || s.markerSession == "" {
+		return 0, false
+	}
+	id, isID := row[0].(int64)
+	session, isSession := row[1].(string)
+	return id, isID && isSession && session == s.markerSession
+}
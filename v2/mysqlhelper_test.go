@@ -0,0 +1,41 @@
+package mysqlbinlog
+
+import "testing"
+
+func TestOwnMarker(t *testing.T) {
+	session, err := newMarkerSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newMarkerSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session == other || len(session) > 64 {
+		t.Fatalf("session ids %q and %q should differ and fit the session column", session, other)
+	}
+
+	s := &Session{markerSession: session}
+	cases := []struct {
+		name   string
+		row    []interface{}
+		wantID int64
+		wantOK bool
+	}{
+		{"own", []interface{}{int64(7), session}, 7, true},
+		{"other session", []interface{}{int64(8), other}, 0, false},
+		{"single column table", []interface{}{int64(9)}, 0, false},
+		{"missing session", []interface{}{int64(10), nil}, 0, false},
+	}
+	for _, c := range cases {
+		id, ok := s.ownMarker(c.row)
+		if ok != c.wantOK || (ok && id != c.wantID) {
+			t.Errorf("%s: ownMarker = %d, %t, want %d, %t", c.name, id, ok, c.wantID, c.wantOK)
+		}
+	}
+
+	// Flashback has no session, markers in the files belong to others
+	if _, ok := (&Session{}).ownMarker([]interface{}{int64(1), ""}); ok {
+		t.Error("a session without marker id owns a marker")
+	}
+}
@@ -0,0 +1,265 @@
+package mysqlbinlog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PreflightCheck is the result of checking one server setting or privilege the library relies on
+type PreflightCheck struct {
+	Name    string
+	Passed  bool
+	Warning bool   // the check could not tell, or the problem only limits some features
+	Message string // what is wrong and how to fix it, empty if passed
+}
+
+// PreflightReport lists the checks run by Preflight
+type PreflightReport struct {
+	Version string // result of SELECT VERSION()
+	Checks  []PreflightCheck
+}
+
+// Failed returns the checks which failed, warnings are left out
+func (r *PreflightReport) Failed() []PreflightCheck {
+	var failed []PreflightCheck
+	for _, c := range r.Checks {
+		if !c.Passed && !c.Warning {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+func (r *PreflightReport) pass(name string) {
+	r.Checks = append(r.Checks, PreflightCheck{Name: name, Passed: true})
+}
+
+func (r *PreflightReport) fail(name string, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, PreflightCheck{Name: name, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *PreflightReport) warn(name string, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, PreflightCheck{Name: name, Warning: true, Message: fmt.Sprintf(format, args...)})
+}
+
+// PreflightError is returned by Start and NewSession when some preflight checks fail
+type PreflightError struct {
+	Host   string
+	Port   uint
+	Failed []PreflightCheck
+}
+
+func (e *PreflightError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, c := range e.Failed {
+		msgs[i] = fmt.Sprintf("%s: %s", c.Name, c.Message)
+	}
+	return fmt.Sprintf("server %s:%d failed %d preflight check(s): %s", e.Host, e.Port, len(e.Failed), strings.Join(msgs, "; "))
+}
+
+// supportedAuthPlugins are the auth plugins the replication client can log in with
+var supportedAuthPlugins = map[string]bool{
+	"mysql_native_password": true,
+	"caching_sha2_password": true,
+	"sha256_password":       true,
+}
+
+// Preflight checks the binlog settings and the privileges of user on the server without starting a session,
+// Start and NewSession run the same checks. The error is only set if the server can not be queried at all.
+func Preflight(host string, port uint, user string, password string, opts ...Option) (*PreflightReport, error) {
+	s := &Session{conf: newConfCmd(host, port, user, password, opts...)}
+	report, _, err := s.preflight()
+	return report, err
+}
+
+// preflight runs the checks on a connection of its own, getDBCon already needs the privilege to disable binlog
+func (s *Session) preflight() (*PreflightReport, serverVersion, error) {
+	con, err := connectMysql(s.mysqlUrl())
+	if err != nil {
+		return nil, serverVersion{}, fmt.Errorf("fail to connect to mysql %s:%d, err=%s", s.conf.Host, s.conf.Port, err.Error())
+	}
+	defer con.Close()
+
+	version, err := getServerVersion(con)
+	if err != nil {
+		return nil, serverVersion{}, fmt.Errorf("failed to get server version, err=%s", err.Error())
+	}
+	report := &PreflightReport{Version: version.raw}
+
+	if err := checkServerSettings(con, report); err != nil {
+		return nil, version, err
+	}
+	checkAuthPlugin(con, report, s.conf.User)
+	checkPrivileges(con, report, version)
+	checkDisableBinlog(con, report)
+	checkInformationSchema(con, report)
+
+	for _, c := range report.Checks {
+		if c.Warning {
+			logrus.Warnf("preflight check %s: %s", c.Name, c.Message)
+		}
+	}
+	return report, version, nil
+}
+
+func checkServerSettings(con *sql.DB, report *PreflightReport) error {
+	rows, err := con.Query(serverSettingsSQL)
+	if err != nil {
+		return fmt.Errorf("failed to read server variables, err=%s", err.Error())
+	}
+	settings := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		settings[strings.ToLower(name)] = strings.ToUpper(value)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if v := settings["log_bin"]; v != "ON" && v != "1" {
+		report.fail("log_bin", "log_bin is %s, start the server with --log-bin to enable binlog", v)
+	} else {
+		report.pass("log_bin")
+	}
+	if v := settings["binlog_format"]; v != "ROW" {
+		report.fail("binlog_format", "binlog_format is %s, set binlog_format=ROW in the server config, statement based events can not be rolled back", v)
+	} else {
+		report.pass("binlog_format")
+	}
+	if v, ok := settings["binlog_row_image"]; ok && v != "FULL" {
+		report.warn("binlog_row_image", "binlog_row_image is %s, deleted rows and updated columns missing from the row images can not be rolled back, set binlog_row_image=FULL", v)
+	} else {
+		report.pass("binlog_row_image")
+	}
+	// MySQL 8.0.20+ can wrap transactions into compressed payload events, the binlog library can not decode them
+	if v, ok := settings["binlog_transaction_compression"]; ok && v != "OFF" && v != "0" {
+		report.fail("binlog_transaction_compression", "binlog_transaction_compression is %s, set it to OFF, compressed transaction payloads can not be decoded", v)
+	} else {
+		report.pass("binlog_transaction_compression")
+	}
+	return nil
+}
+
+// checkAuthPlugin makes sure the replication client can log in, MySQL 8 creates users with caching_sha2_password by default
+func checkAuthPlugin(con *sql.DB, report *PreflightReport, user string) {
+	var plugin string
+	if err := con.QueryRow(authPluginSQL).Scan(&plugin); err != nil {
+		report.warn("auth_plugin", "failed to read the auth plugin of user %s, it may lack SELECT on mysql.user, err=%s", user, err.Error())
+		return
+	}
+	if plugin != "" && !supportedAuthPlugins[plugin] {
+		report.fail("auth_plugin", "user %s authenticates with %s, which the replication client does not support, ALTER USER it to caching_sha2_password or mysql_native_password", user, plugin)
+		return
+	}
+	report.pass("auth_plugin")
+}
+
+// checkPrivileges looks for the replication privileges in the global grants of the current user and of its
+// active roles. A privilege not found is a warning, it may come through a grant the check can not read.
+func checkPrivileges(con *sql.DB, report *PreflightReport, version serverVersion) {
+	grants, err := queryGrants(con, "SHOW GRANTS FOR CURRENT_USER();")
+	if err != nil {
+		report.warn("privileges", "failed to read the grants of the current user, err=%s", err.Error())
+		return
+	}
+	// MySQL 8 lists the privileges of roles only with USING
+	if !version.mariadb && version.atLeast(8, 0, 0) {
+		var roles string
+		if err := con.QueryRow("SELECT CURRENT_ROLE();").Scan(&roles); err != nil {
+			logrus.Debugf("failed to read the active roles, err=%s", err.Error())
+		} else if roles != "" && roles != "NONE" {
+			if roleGrants, err := queryGrants(con, "SHOW GRANTS FOR CURRENT_USER() USING "+roles+";"); err != nil {
+				logrus.Debugf("failed to read the grants of roles %s, err=%s", roles, err.Error())
+			} else {
+				grants = append(grants, roleGrants...)
+			}
+		}
+	}
+
+	if hasGlobalPrivilege(grants, "REPLICATION SLAVE", "REPLICATION REPLICA") {
+		report.pass("replication_slave")
+	} else {
+		report.warn("replication_slave", "no grant of REPLICATION SLAVE found for the user, which is needed to read the binlog stream, GRANT REPLICATION SLAVE ON *.* TO it unless a role grants it")
+	}
+	// MariaDB 10.5 renamed REPLICATION CLIENT to BINLOG MONITOR
+	if hasGlobalPrivilege(grants, "REPLICATION CLIENT", "BINLOG MONITOR") {
+		report.pass("replication_client")
+	} else {
+		report.warn("replication_client", "no grant of REPLICATION CLIENT found for the user, which is needed to read the binlog position with %s, GRANT REPLICATION CLIENT ON *.* TO it unless a role grants it", strings.TrimSuffix(version.binlogStatusSQL(), ";"))
+	}
+}
+
+func queryGrants(con *sql.DB, query string) ([]string, error) {
+	rows, err := con.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var grants []string
+	for rows.Next() {
+		var grant string
+		if err := rows.Scan(&grant); err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+// hasGlobalPrivilege tells whether one of grants, lines of SHOW GRANTS, gives one of privs or all privileges on *.*
+func hasGlobalPrivilege(grants []string, privs ...string) bool {
+	for _, grant := range grants {
+		grant = strings.ToUpper(grant)
+		if !strings.Contains(grant, " ON *.* ") {
+			continue
+		}
+		if strings.Contains(grant, "ALL PRIVILEGES") {
+			return true
+		}
+		for _, priv := range privs {
+			if strings.Contains(grant, priv) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkDisableBinlog makes sure rollback SQLs can be executed without being written to the binlog
+func checkDisableBinlog(con *sql.DB, report *PreflightReport) {
+	conn, err := con.Conn(context.Background())
+	if err != nil {
+		report.warn("sql_log_bin", "failed to get a connection, err=%s", err.Error())
+		return
+	}
+	// the variable is only changed for this connection, the pool is closed after the preflight
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), disableBinlogSQL); err != nil {
+		report.fail("sql_log_bin", "the user can not disable binlog for its session, GRANT SUPER or SYSTEM_VARIABLES_ADMIN (MySQL 8) ON *.* TO it, err=%s", err.Error())
+		return
+	}
+	report.pass("sql_log_bin")
+}
+
+// checkInformationSchema makes sure the table schemas can be read
+func checkInformationSchema(con *sql.DB, report *PreflightReport) {
+	var count int
+	if err := con.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_type='BASE TABLE' AND table_schema NOT IN ('information_schema', 'performance_schema', 'mysql', 'sys');").Scan(&count); err != nil {
+		report.fail("information_schema", "failed to read information_schema.tables, GRANT SELECT on the tested databases to the user, err=%s", err.Error())
+		return
+	}
+	if count == 0 {
+		report.warn("information_schema", "no user table is visible in information_schema, check the user has SELECT on the tested databases")
+		return
+	}
+	report.pass("information_schema")
+}
@@ -0,0 +1,24 @@
+package mysqlbinlog
+
+import "testing"
+
+func TestHasGlobalPrivilege(t *testing.T) {
+	cases := []struct {
+		name   string
+		grants []string
+		want   bool
+	}{
+		{"direct", []string{"GRANT SELECT, REPLICATION SLAVE ON *.* TO `u`@`%`"}, true},
+		{"all privileges", []string{"GRANT ALL PRIVILEGES ON *.* TO `root`@`localhost` WITH GRANT OPTION"}, true},
+		{"lower case", []string{"grant replication slave on *.* to 'u'@'%'"}, true},
+		{"role grants with USING", []string{"GRANT USAGE ON *.* TO `u`@`%`", "GRANT `repl`@`%` TO `u`@`%`", "GRANT REPLICATION SLAVE ON *.* TO `u`@`%`"}, true},
+		{"database grant only", []string{"GRANT ALL PRIVILEGES ON `shop`.* TO `u`@`%`"}, false},
+		{"role not resolved", []string{"GRANT USAGE ON *.* TO `u`@`%`", "GRANT `repl`@`%` TO `u`@`%`"}, false},
+		{"no grants", nil, false},
+	}
+	for _, c := range cases {
+		if got := hasGlobalPrivilege(c.grants, "REPLICATION SLAVE", "REPLICATION REPLICA"); got != c.want {
+			t.Errorf("%s: hasGlobalPrivilege = %t, want %t", c.name, got, c.want)
+		}
+	}
+}
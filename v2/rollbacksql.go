@@ -1,6 +1,7 @@
 package mysqlbinlog
 
 import (
+	"context"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"strings"
@@ -11,80 +12,178 @@ type rollbackEntry struct {
 	SQL      string
 	DB       string // database name, used for auto increment reset
 	Table    string // table name, used for auto increment reset
+	ThreadID uint32 // id of the connection which made the change, used to dispatch it to its scope
+	Pos      string // binlog position of the change, see getPosStr
+	GTID     string // GTID of the transaction of the change, empty without gtid_mode
+	Query    string // statement which made the change, if the server annotates rows events
+	SqlType  SQLType
+
+	Irreversible string // why the change can not be reverted, SQL is empty then
+	Wiped        bool   // the table is truncated or dropped by Query, restored from its shadow snapshot
+}
+
+// RollbackStatement is a rollback SQL with the change it reverts,
+// or the original SQL of the change if Flashback runs with GenModeForward
+type RollbackStatement struct {
+	SQL   string
+	DB    string
+	Table string
+	Pos   string  // binlog position of the change, empty for auto increment resets
+	GTID  string  // GTID of the transaction of the change, empty for auto increment resets or without gtid_mode
+	Query string  // statement which made the change, if binlog_rows_query_log_events or binlog_annotate_row_events is on
+	Type  SQLType // type of the change, SQLTypeQuery for auto increment resets
+
+	Irreversible string // why the change can not be reverted, SQL is empty then
 }
 
 type RollbackSQL struct {
-	sqls chan rollbackEntry
+	sqls    chan rollbackEntry
+	pending []rollbackEntry // entries read by a cancelled collectRollbackSQL, not rolled back yet
+	stop    <-chan struct{} // closed when the session stops, nobody reads sqls anymore
 }
 
-func (sql *RollbackSQL) appendGeneralSQLs(sqls []string, db, table string) {
+func (entry rollbackEntry) statement() RollbackStatement {
+	return RollbackStatement{
+		SQL:   strings.Trim(entry.SQL, " \r\n"),
+		DB:    entry.DB,
+		Table: entry.Table,
+		Pos:   entry.Pos,
+		GTID:  entry.GTID,
+		Query: entry.Query,
+		Type:  entry.SqlType,
+
+		Irreversible: entry.Irreversible,
+	}
+}
+
+// appendGeneralSQLs appends sqls reverting the change described by src
+func (sql *RollbackSQL) appendGeneralSQLs(sqls []string, src rollbackEntry) {
 	for _, s := range sqls {
-		sql.sqls <- rollbackEntry{MarkerID: -1, SQL: s, DB: db, Table: table}
+		entry := src
+		entry.MarkerID = -1
+		entry.SQL = s
+		sql.append(entry)
 	}
 }
 
 func (sql *RollbackSQL) appendMarker(markerID int64) {
-	sql.sqls <- rollbackEntry{MarkerID: markerID}
+	sql.append(rollbackEntry{MarkerID: markerID})
 }
 
-// Only concatenate rollback SQLs with ID <= markerID
-func (sql *RollbackSQL) collectRollbackSQL(markerID int64) []string {
-	var newSqls []string
-	resetAutoIncrementTables := map[string]map[string]struct{}{} // map[db][table]bool, used to reset auto increment id
+func (sql *RollbackSQL) append(entry rollbackEntry) {
+	select {
+	case sql.sqls <- entry:
+	case <-sql.stop:
+	}
+}
+
+// collectRollbackEntries reads the queue until markerID is reached, entries before the marker are returned
+func (sql *RollbackSQL) collectRollbackEntries(ctx context.Context, markerID int64) ([]rollbackEntry, error) {
+	// continue with the entries read by a cancelled call
+	entries := sql.pending
+	sql.pending = nil
+
 	// read from sql.sqls, utill markerID is reached
-	for entry := range sql.sqls {
-		// if not marker ID, then it is a general SQL
-		if entry.MarkerID == -1 {
-			if strings.Trim(entry.SQL, " \r\n") != "" {
-				newSqls = append(newSqls, strings.Trim(entry.SQL, " \r\n"))
-				if _, ok := resetAutoIncrementTables[entry.DB]; !ok {
-					resetAutoIncrementTables[entry.DB] = make(map[string]struct{})
-				}
-				resetAutoIncrementTables[entry.DB][entry.Table] = struct{}{}
-			} else {
-				logrus.Warnf("Warning: empty SQL %s found in rollback entries, skipping it", entry.SQL)
+	for {
+		select {
+		case <-ctx.Done():
+			// keep them for the next call, the marker is still on its way
+			sql.pending = entries
+			return nil, ctx.Err()
+		case entry, ok := <-sql.sqls:
+			if !ok {
+				sql.pending = entries
+				return nil, fmt.Errorf("binlog listener stopped before marker ID %d is reached", markerID)
+			}
+			// if not marker ID, then it is a general SQL
+			if entry.MarkerID == -1 {
+				entries = append(entries, entry)
+				continue
+			}
+			if entry.MarkerID < markerID {
+				// left by a call which gave up waiting for it
+				logrus.Infof("skip stale marker ID %d, expected %d", entry.MarkerID, markerID)
+				continue
 			}
-		} else {
 			if entry.MarkerID != markerID {
-				logrus.Panicf("Error: marker ID %d not match with expected %d, please check your binlog position", entry.MarkerID, markerID)
+				// keep them for the next call, like when the listener stops
+				sql.pending = entries
+				return nil, fmt.Errorf("marker ID %d not match with expected %d, please check your binlog position", entry.MarkerID, markerID)
+			}
+			return entries, nil
+		}
+	}
+}
+
+// collectRollbackSQL concatenates the rollback SQLs of entries in reversed order,
+// followed by the SQLs to reset auto increment ids of the touched tables
+func collectRollbackSQL(entries []rollbackEntry, tbInfos *tablesColumnsInfo) []string {
+	stmts := collectRollbackStatements(entries, tbInfos)
+	sqls := make([]string, len(stmts))
+	for i, stmt := range stmts {
+		sqls[i] = stmt.SQL
+	}
+	return sqls
+}
+
+// collectRollbackStatements is collectRollbackSQL keeping the change each SQL reverts
+func collectRollbackStatements(entries []rollbackEntry, tbInfos *tablesColumnsInfo) []RollbackStatement {
+	changes, resets := splitRollbackStatements(entries, tbInfos)
+	return append(changes, resets...)
+}
+
+// splitRollbackStatements returns the rollback SQLs of entries in reversed order and the SQLs to reset
+// auto increment ids apart, the latter commit implicitly so they can not run in the rollback transaction
+func splitRollbackStatements(entries []rollbackEntry, tbInfos *tablesColumnsInfo) ([]RollbackStatement, []RollbackStatement) {
+	var newSqls []RollbackStatement
+	resetAutoIncrementTables := map[string]map[string]struct{}{} // map[db][table]bool, used to reset auto increment id
+	for _, entry := range entries {
+		if entry.Irreversible != "" || entry.Wiped {
+			// reported by irreversibleStatements, or restored from shadow snapshots
+			continue
+		}
+		if strings.Trim(entry.SQL, " \r\n") != "" {
+			newSqls = append(newSqls, entry.statement())
+			if entry.SqlType == SQLTypeDDL {
+				// a created table has nothing to reset, a re-created one starts from its snapshot
+				continue
+			}
+			if _, ok := resetAutoIncrementTables[entry.DB]; !ok {
+				resetAutoIncrementTables[entry.DB] = make(map[string]struct{})
 			}
-			break
+			resetAutoIncrementTables[entry.DB][entry.Table] = struct{}{}
+		} else {
+			logrus.Warnf("Warning: empty SQL %s found in rollback entries, skipping it", entry.SQL)
 		}
 	}
 
 	// reset table auto increment id
-	var setAutoIncrementSQLs []string
+	var setAutoIncrementSQLs []RollbackStatement
 	for db, tbls := range resetAutoIncrementTables {
 		for tb := range tbls {
 			tbKey := getTableName(db, tb)
-			tbInfo, ok := tableinfo.tableInfos[tbKey]
-			if ok && tbInfo != nil {
-				setAutoIncrementSQLs = append(setAutoIncrementSQLs, fmt.Sprintf(setAutoIncrementSQL, db, tb, tbInfo.AutoIncrement))
+			if autoIncrement, ok := tbInfos.autoIncrement(tbKey); ok {
+				setAutoIncrementSQLs = append(setAutoIncrementSQLs, RollbackStatement{
+					SQL:   fmt.Sprintf(setAutoIncrementSQL, db, tb, autoIncrement),
+					DB:    db,
+					Table: tb,
+					Type:  SQLTypeQuery,
+				})
 			}
 		}
 	}
 
 	// return reversed SQLs
-	return append(ReverseSlice(newSqls), setAutoIncrementSQLs...)
+	return ReverseSlice(newSqls), setAutoIncrementSQLs
 }
 
-func (sql *RollbackSQL) begin() {
-	markerID, err := insertMarkerID()
-	if err != nil {
-		logrus.Panicf("failed to insert marker id, err=%s", err.Error())
-	}
-
-	// 2. Collect rollback SQL
-	sqls := rollbackSQL.collectRollbackSQL(markerID)
-
-	// 3. Execute SQLs
-	if len(sqls) > 0 {
-		logrus.Warnf("starting a new rollback cycle with markerID=%d, the already collected SQLs below will be discarded(%s)", markerID, strings.Join(sqls, ";\n"))
-	} else {
-		logrus.Infof("starting a new rollback cycle with markerID=%d", markerID)
+// irreversibleStatements returns the DDL of entries which can not be reverted, latest first
+func irreversibleStatements(entries []rollbackEntry) []RollbackStatement {
+	var stmts []RollbackStatement
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Irreversible != "" {
+			stmts = append(stmts, entries[i].statement())
+		}
 	}
-}
-
-var rollbackSQL = &RollbackSQL{
-	sqls: make(chan rollbackEntry, 1000),
+	return stmts
 }
@@ -0,0 +1,29 @@
+package mysqlbinlog
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCollectRollbackEntriesKeepsEntriesOnMarkerMismatch(t *testing.T) {
+	sql := &RollbackSQL{sqls: make(chan rollbackEntry, 10)}
+	sql.appendGeneralSQLs([]string{"DELETE FROM `shop`.`orders` WHERE `id`=1"}, rollbackEntry{DB: "shop", Table: "orders"})
+	sql.appendMarker(5)
+
+	if _, err := sql.collectRollbackEntries(context.Background(), 3); err == nil {
+		t.Fatal("collectRollbackEntries with a later marker succeeded, want an error")
+	}
+	if len(sql.pending) != 1 {
+		t.Fatalf("pending = %+v, want the entry read before the marker", sql.pending)
+	}
+
+	sql.appendGeneralSQLs([]string{"DELETE FROM `shop`.`orders` WHERE `id`=2"}, rollbackEntry{DB: "shop", Table: "orders"})
+	sql.appendMarker(6)
+	entries, err := sql.collectRollbackEntries(context.Background(), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].SQL != "DELETE FROM `shop`.`orders` WHERE `id`=1" || entries[1].SQL != "DELETE FROM `shop`.`orders` WHERE `id`=2" {
+		t.Errorf("entries = %+v, want both DELETEs in order", entries)
+	}
+}
@@ -0,0 +1,210 @@
+package mysqlbinlog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/manilion/godropbox/database/sqlbuilder"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// Rows events written with binlog_row_image=MINIMAL or NOBLOB only carry some columns of a row, the column
+// bitmaps of the event tell which ones. An absent column is decoded as nil, just like NULL, so the
+// generators below work on the bitmaps instead of the values.
+
+// rowImagePresence returns which columns are present in the first and second row images of rEv,
+// the second one is nil except for update events
+func rowImagePresence(rEv *replication.RowsEvent) ([]bool, []bool) {
+	image1 := bitmapToPresence(rEv.ColumnBitmap1, int(rEv.ColumnCount))
+	var image2 []bool
+	if rEv.ColumnBitmap2 != nil {
+		image2 = bitmapToPresence(rEv.ColumnBitmap2, int(rEv.ColumnCount))
+	}
+	return image1, image2
+}
+
+func bitmapToPresence(bitmap []byte, colCnt int) []bool {
+	present := make([]bool, colCnt)
+	for i := range present {
+		present[i] = bitmap == nil || (i/8 < len(bitmap) && bitmap[i/8]&(1<<uint(i%8)) != 0)
+	}
+	return present
+}
+
+// filterStoredGeneratedPresence drops the stored generated columns from present, like filterStoredGeneratedFields
+func filterStoredGeneratedPresence(names []fieldInfo, present []bool) []bool {
+	if present == nil {
+		return nil
+	}
+	var filtered []bool
+	for i, p := range present {
+		if i < len(names) && names[i].Extra == "STORED GENERATED" {
+			continue
+		}
+		filtered = append(filtered, p)
+	}
+	return filtered
+}
+
+func isFullImage(present []bool) bool {
+	for _, p := range present {
+		if !p {
+			return false
+		}
+	}
+	return true
+}
+
+func missingColumns(present []bool, idxs []int, names []fieldInfo) []string {
+	var missing []string
+	for _, idx := range idxs {
+		if idx < len(present) && !present[idx] {
+			missing = append(missing, names[idx].FieldName)
+		}
+	}
+	return missing
+}
+
+func allColumnIdxs(colCnt int) []int {
+	idxs := make([]int, colCnt)
+	for i := range idxs {
+		idxs[i] = i
+	}
+	return idxs
+}
+
+// partialImageError tells why a change logged with a partial row image can not be turned into SQL
+func partialImageError(posStr string, rEv *replication.RowsEvent, what string, missing []string) error {
+	return fmt.Errorf("can not %s for %s at %s, the row image lacks columns %s, set binlog_row_image=FULL",
+		what, getTableName(string(rEv.Table.Schema), string(rEv.Table.Table)), posStr, strings.Join(missing, ", "))
+}
+
+// projectColumns keeps the present columns of rEv, and returns the unique key indexes in the kept columns
+func projectColumns(rEv *replication.RowsEvent, colDefs []sqlbuilder.NonAliasColumn, present []bool, uniKey []int) (*replication.RowsEvent, []sqlbuilder.NonAliasColumn, []int) {
+	var kept []int
+	newIdx := map[int]int{}
+	for i, p := range present {
+		if p {
+			newIdx[i] = len(kept)
+			kept = append(kept, i)
+		}
+	}
+	projected := *rEv
+	projected.Rows = make([][]interface{}, len(rEv.Rows))
+	for ri, row := range rEv.Rows {
+		newRow := make([]interface{}, len(kept))
+		for ni, ci := range kept {
+			newRow[ni] = row[ci]
+		}
+		projected.Rows[ri] = newRow
+	}
+	newDefs := make([]sqlbuilder.NonAliasColumn, len(kept))
+	for ni, ci := range kept {
+		newDefs[ni] = colDefs[ci]
+	}
+	var newKey []int
+	for _, idx := range uniKey {
+		if ni, ok := newIdx[idx]; ok {
+			newKey = append(newKey, ni)
+		}
+	}
+	return &projected, newDefs, newKey
+}
+
+// genPartialImageSqls generates the SQLs of a rows event with a partial row image, the rollback ones
+// or the original ones with forward. A change whose image lacks the columns needed is an error.
+func genPartialImageSqls(posStr string, sqlType SQLType, rEv *replication.RowsEvent, colDefs []sqlbuilder.NonAliasColumn, names []fieldInfo,
+	uniKey []int, image1, image2 []bool, forward bool) ([]string, error) {
+	switch {
+	case sqlType == SQLTypeInsert && forward:
+		projected, defs, _ := projectColumns(rEv, colDefs, image1, nil)
+		return genInsertSqls(posStr, projected, defs, 20, true), nil
+	case sqlType == SQLTypeDelete && !forward:
+		// the deleted row must be inserted back as a whole
+		return nil, partialImageError(posStr, rEv, "insert the deleted rows back", missingColumns(image1, allColumnIdxs(len(image1)), names))
+	case sqlType == SQLTypeInsert || sqlType == SQLTypeDelete:
+		// delete the inserted rows, or the deleted ones forward, by the key in the image
+		if len(uniKey) > 0 {
+			if missing := missingColumns(image1, uniKey, names); len(missing) > 0 {
+				return nil, partialImageError(posStr, rEv, "identify the rows by their key", missing)
+			}
+		}
+		projected, defs, key := projectColumns(rEv, colDefs, image1, uniKey)
+		return genDeleteSqls(posStr, projected, defs, key, false, true), nil
+	case sqlType == SQLTypeUpdate:
+		return genPartialUpdateSqls(posStr, rEv, colDefs, names, uniKey, image1, image2, forward)
+	}
+	return nil, nil
+}
+
+// genPartialUpdateSqls sets the columns written by the update, found in the after image, back to their
+// before values, or to their after values with forward. The row is found by its key as it is in the
+// database before the generated SQL runs: the after image, or the before image with forward.
+func genPartialUpdateSqls(posStr string, rEv *replication.RowsEvent, colDefs []sqlbuilder.NonAliasColumn, names []fieldInfo,
+	uniKey []int, before, after []bool, forward bool) ([]string, error) {
+	var (
+		schema = string(rEv.Table.Schema)
+		table  = string(rEv.Table.Table)
+		sqlArr []string
+	)
+	whereIdxs := uniKey
+	if len(whereIdxs) == 0 {
+		whereIdxs = allColumnIdxs(len(colDefs))
+	}
+
+	for i := 0; i+1 < len(rEv.Rows); i += 2 {
+		rowBefore, rowAfter := rEv.Rows[i], rEv.Rows[i+1]
+
+		upSql := sqlbuilder.NewTable(table, colDefs...).Update()
+		setCnt := 0
+		for ci := range colDefs {
+			if !after[ci] {
+				continue
+			}
+			if forward {
+				upSql.Set(colDefs[ci], literal(rowAfter[ci]))
+				setCnt++
+				continue
+			}
+			if !before[ci] {
+				return nil, partialImageError(posStr, rEv, "restore the updated columns", []string{names[ci].FieldName})
+			}
+			if equalValues(rowBefore[ci], rowAfter[ci]) {
+				continue
+			}
+			upSql.Set(colDefs[ci], literal(rowBefore[ci]))
+			setCnt++
+		}
+		if setCnt == 0 {
+			continue
+		}
+
+		var wherePart []sqlbuilder.BoolExpression
+		for _, ci := range whereIdxs {
+			var v interface{}
+			switch {
+			case !forward && after[ci]:
+				v = rowAfter[ci]
+			case before[ci]:
+				// a column absent from the after image is not changed by the update
+				v = rowBefore[ci]
+			case len(uniKey) > 0:
+				return nil, partialImageError(posStr, rEv, "identify the rows by their key", []string{names[ci].FieldName})
+			default:
+				// no key, match the columns at hand
+				continue
+			}
+			wherePart = append(wherePart, eqL(colDefs[ci], v))
+		}
+		if len(wherePart) == 0 {
+			return nil, partialImageError(posStr, rEv, "identify the rows", missingColumns(before, whereIdxs, names))
+		}
+		upSql.Where(sqlbuilder.And(wherePart...))
+		sql, err := upSql.String(schema)
+		if err != nil {
+			return nil, fmt.Errorf("fail to generate update sql for %s %s, err=%s", getTableName(schema, table), posStr, err.Error())
+		}
+		sqlArr = append(sqlArr, sql)
+	}
+	return sqlArr, nil
+}
@@ -0,0 +1,156 @@
+package mysqlbinlog
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/manilion/godropbox/database/sqlbuilder"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// orders has id INT, note VARCHAR and qty INT
+func ordersColumns() ([]sqlbuilder.NonAliasColumn, []fieldInfo) {
+	_, id := getMysqlDataTypeNameAndSqlColumn("int", "id", mysql.MYSQL_TYPE_LONG, 0)
+	_, note := getMysqlDataTypeNameAndSqlColumn("varchar", "note", mysql.MYSQL_TYPE_VARCHAR, 0)
+	_, qty := getMysqlDataTypeNameAndSqlColumn("int", "qty", mysql.MYSQL_TYPE_LONG, 0)
+	names := []fieldInfo{{FieldName: "id", FieldType: "int"}, {FieldName: "note", FieldType: "varchar"}, {FieldName: "qty", FieldType: "int"}}
+	return []sqlbuilder.NonAliasColumn{id, note, qty}, names
+}
+
+func ordersRowsEvent(rows ...[]interface{}) *replication.RowsEvent {
+	return &replication.RowsEvent{
+		Table: &replication.TableMapEvent{Schema: []byte("shop"), Table: []byte("orders")},
+		Rows:  rows,
+	}
+}
+
+func TestBitmapToPresence(t *testing.T) {
+	cases := []struct {
+		name   string
+		bitmap []byte
+		colCnt int
+		want   []bool
+	}{
+		{"no bitmap", nil, 3, []bool{true, true, true}},
+		{"some columns", []byte{0x05}, 3, []bool{true, false, true}},
+		{"second byte", []byte{0xff, 0x01}, 9, []bool{true, true, true, true, true, true, true, true, true}},
+		{"short bitmap", []byte{0x01}, 9, []bool{true, false, false, false, false, false, false, false, false}},
+		{"no column", []byte{0x00}, 2, []bool{false, false}},
+	}
+	for _, c := range cases {
+		if got := bitmapToPresence(c.bitmap, c.colCnt); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: bitmapToPresence = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestProjectColumns(t *testing.T) {
+	cols, _ := ordersColumns()
+	ev := ordersRowsEvent([]interface{}{int32(1), nil, int32(3)}, []interface{}{int32(2), nil, int32(4)})
+	present := []bool{true, false, true}
+
+	projected, defs, key := projectColumns(ev, cols, present, []int{0, 2})
+	if want := [][]interface{}{{int32(1), int32(3)}, {int32(2), int32(4)}}; !reflect.DeepEqual(projected.Rows, want) {
+		t.Errorf("rows = %v, want %v", projected.Rows, want)
+	}
+	var names []string
+	for _, def := range defs {
+		names = append(names, def.Name())
+	}
+	if want := []string{"id", "qty"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("columns = %v, want %v", names, want)
+	}
+	if want := []int{0, 1}; !reflect.DeepEqual(key, want) {
+		t.Errorf("key = %v, want %v", key, want)
+	}
+	if len(ev.Rows[0]) != 3 || projected.Table != ev.Table {
+		t.Error("projectColumns changed the event or dropped its table")
+	}
+
+	// a key column absent from the image is dropped from the key
+	if _, _, key := projectColumns(ev, cols, present, []int{1}); len(key) != 0 {
+		t.Errorf("key with an absent column = %v, want none", key)
+	}
+}
+
+func TestGenPartialUpdateSqls(t *testing.T) {
+	cols, names := ordersColumns()
+	all := []bool{true, true, true}
+	cases := []struct {
+		name          string
+		before, after []bool
+		rows          [][]interface{}
+		uniKey        []int
+		forward       bool
+		want          []string
+		wantErr       string
+	}{
+		{
+			name:   "noblob, set the updated column back",
+			before: all, after: []bool{true, false, true},
+			rows:   [][]interface{}{{int32(1), "a", int32(3)}, {int32(1), nil, int32(5)}},
+			uniKey: []int{0},
+			want:   []string{"UPDATE `shop`.`orders` SET `orders`.`qty`=3 WHERE `orders`.`id`=1"},
+		},
+		{
+			name:   "key changed, found by its after value",
+			before: all, after: []bool{true, false, false},
+			rows:   [][]interface{}{{int32(1), "a", int32(3)}, {int32(2), nil, nil}},
+			uniKey: []int{0},
+			want:   []string{"UPDATE `shop`.`orders` SET `orders`.`id`=1 WHERE `orders`.`id`=2"},
+		},
+		{
+			name:   "forward sets the after image, found by the before key",
+			before: []bool{true, false, false}, after: []bool{false, false, true},
+			rows:    [][]interface{}{{int32(1), nil, nil}, {nil, nil, int32(5)}},
+			uniKey:  []int{0},
+			forward: true,
+			want:    []string{"UPDATE `shop`.`orders` SET `orders`.`qty`=5 WHERE `orders`.`id`=1"},
+		},
+		{
+			name:   "minimal before image lacks the updated column",
+			before: []bool{true, false, false}, after: []bool{false, false, true},
+			rows:    [][]interface{}{{int32(1), nil, nil}, {nil, nil, int32(5)}},
+			uniKey:  []int{0},
+			wantErr: "lacks columns qty",
+		},
+		{
+			name:   "key missing from both images",
+			before: []bool{false, true, true}, after: []bool{false, false, true},
+			rows:    [][]interface{}{{nil, "a", int32(3)}, {nil, nil, int32(5)}},
+			uniKey:  []int{0},
+			wantErr: "lacks columns id",
+		},
+		{
+			name:   "no key, match the columns at hand",
+			before: []bool{false, true, true}, after: []bool{false, false, true},
+			rows: [][]interface{}{{nil, "a", int32(3)}, {nil, nil, int32(5)}},
+			want: []string{"UPDATE `shop`.`orders` SET `orders`.`qty`=3 WHERE (`orders`.`note`='a' AND `orders`.`qty`=5)"},
+		},
+		{
+			name:   "unchanged values are not set",
+			before: all, after: []bool{true, false, true},
+			rows:   [][]interface{}{{int32(1), "a", int32(3)}, {int32(1), nil, int32(3)}},
+			uniKey: []int{0},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sqls, err := genPartialUpdateSqls("binlog.000001 100-200", ordersRowsEvent(c.rows...), cols, names, c.uniKey, c.before, c.after, c.forward)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("err = %v, want one with %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sqls, c.want) {
+				t.Errorf("sqls = %q, want %q", sqls, c.want)
+			}
+		})
+	}
+}
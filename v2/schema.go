@@ -0,0 +1,51 @@
+package mysqlbinlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// SaveSchemaSnapshot writes the table schemas of the server to path, for WithSchemaFile.
+func SaveSchemaSnapshot(path string, host string, port uint, user string, password string) error {
+	s := &Session{conf: newConfCmd(host, port, user, password), schemaOnly: true}
+	defer func() {
+		if s.sqlCon != nil {
+			_ = s.sqlCon.Close()
+		}
+	}()
+
+	if err := s.getTableInfo(mysql.Position{}); err != nil {
+		return fmt.Errorf("failed to get table info, err=%s", err.Error())
+	}
+	tables := s.tableinfo.tables()
+	b, err := json.MarshalIndent(tables, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("failed to write schema snapshot %s, err=%s", path, err.Error())
+	}
+	logrus.Infof("schema snapshot of %d tables written to %s", len(tables), path)
+	return nil
+}
+
+func (s *Session) loadSchemaSnapshot(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read schema snapshot %s, err=%s", path, err.Error())
+	}
+	tableInfos := map[string]*tblInfoJson{}
+	if err := json.Unmarshal(b, &tableInfos); err != nil {
+		return fmt.Errorf("failed to parse schema snapshot %s, err=%s", path, err.Error())
+	}
+	if len(tableInfos) == 0 {
+		return fmt.Errorf("no table found in schema snapshot %s", path)
+	}
+	s.tableinfo.replace(tableInfos, mysql.Position{})
+	logrus.Infof("loaded schema of %d tables from %s", len(tableInfos), path)
+	return nil
+}
@@ -0,0 +1,111 @@
+package mysqlbinlog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Scope collects the changes made by the connections registered to it, so that test cases running
+// in parallel against one database roll back their own changes only.
+// The changes are attributed by the thread id MySQL writes into the binlog for every transaction,
+// so a test case must run all its statements on the connections it registers, e.g. a pinned *sql.Conn.
+type Scope struct {
+	session   *Session
+	threadIDs []uint32
+	entries   []rollbackEntry
+	ended     bool
+}
+
+// BeginScope starts a scope and registers conns to it, more connections can be registered later.
+func (s *Session) BeginScope(ctx context.Context, conns ...*sql.Conn) (*Scope, error) {
+	scope := &Scope{session: s}
+	for _, conn := range conns {
+		if err := scope.RegisterConn(ctx, conn); err != nil {
+			s.cycleMu.Lock()
+			scope.end()
+			s.cycleMu.Unlock()
+			return nil, err
+		}
+	}
+	return scope, nil
+}
+
+// RegisterConn attributes the changes made on conn from now on to the scope.
+func (sc *Scope) RegisterConn(ctx context.Context, conn *sql.Conn) error {
+	var threadID uint32
+	if err := conn.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&threadID); err != nil {
+		return fmt.Errorf("failed to get connection id, err=%w", err)
+	}
+	return sc.RegisterConnID(ctx, threadID)
+}
+
+// RegisterConnID attributes the changes made by the connection with threadID from now on to the scope.
+func (sc *Scope) RegisterConnID(ctx context.Context, threadID uint32) error {
+	s := sc.session
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	if sc.ended {
+		return fmt.Errorf("scope is already rolled back")
+	}
+	if owner, ok := s.scopes[threadID]; ok {
+		if owner == sc {
+			return nil
+		}
+		return fmt.Errorf("connection %d is already registered to another scope", threadID)
+	}
+
+	// changes made by the connection before now belong to its previous owner
+	if _, err := s.syncMarker(ctx); err != nil {
+		return err
+	}
+	s.scopes[threadID] = sc
+	sc.threadIDs = append(sc.threadIDs, threadID)
+	logrus.Infof("connection %d is registered to scope", threadID)
+	return nil
+}
+
+// Rollback reverts the changes made by the registered connections and ends the scope.
+// Verify mode does not check it, the checksums are taken at Begin of the session.
+func (sc *Scope) Rollback() error {
+	return sc.RollbackContext(context.Background())
+}
+
+// RollbackContext is Rollback with a context to bound the wait for the marker and the execution of rollback SQLs.
+func (sc *Scope) RollbackContext(ctx context.Context) error {
+	s := sc.session
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	if sc.ended {
+		return fmt.Errorf("scope is already rolled back")
+	}
+
+	markerID, err := s.syncMarker(ctx)
+	if err != nil {
+		return err
+	}
+	entries := sc.entries
+	execErr := s.execRollback(ctx, markerID, entries, false)
+	if !isIrreversible(execErr) {
+		return execErr
+	}
+	sc.end()
+	if err := s.journal.done(entries); err != nil {
+		return fmt.Errorf("rollback executed, but failed to record it in the journal, err=%w", err)
+	}
+	return execErr
+}
+
+// end unregisters the connections, the caller must hold cycleMu
+func (sc *Scope) end() {
+	for _, threadID := range sc.threadIDs {
+		delete(sc.session.scopes, threadID)
+	}
+	sc.threadIDs = nil
+	sc.entries = nil
+	sc.ended = true
+}
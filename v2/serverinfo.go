@@ -0,0 +1,62 @@
+package mysqlbinlog
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// serverVersion is the parsed result of SELECT VERSION()
+type serverVersion struct {
+	raw                 string
+	major, minor, patch int
+	mariadb             bool
+}
+
+var versionRe = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)`)
+
+func parseServerVersion(raw string) serverVersion {
+	v := serverVersion{raw: raw, mariadb: strings.Contains(strings.ToLower(raw), "mariadb")}
+	if m := versionRe.FindStringSubmatch(raw); m != nil {
+		v.major, _ = strconv.Atoi(m[1])
+		v.minor, _ = strconv.Atoi(m[2])
+		v.patch, _ = strconv.Atoi(m[3])
+	}
+	return v
+}
+
+func (v serverVersion) atLeast(major, minor, patch int) bool {
+	if v.major != major {
+		return v.major > major
+	}
+	if v.minor != minor {
+		return v.minor > minor
+	}
+	return v.patch >= patch
+}
+
+func (v serverVersion) flavor() string {
+	if v.mariadb {
+		return mysql.MariaDBFlavor
+	}
+	return mysql.MySQLFlavor
+}
+
+// binlogStatusSQL returns the statement reporting the current binlog file and position
+func (v serverVersion) binlogStatusSQL() string {
+	if !v.mariadb && v.atLeast(8, 2, 0) {
+		return showBinaryLogStatusSQL
+	}
+	return showMasterStatusSQL
+}
+
+func getServerVersion(con *sql.DB) (serverVersion, error) {
+	var raw string
+	if err := con.QueryRow(versionSQL).Scan(&raw); err != nil {
+		return serverVersion{}, err
+	}
+	return parseServerVersion(raw), nil
+}
@@ -0,0 +1,50 @@
+package mysqlbinlog
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func TestParseServerVersion(t *testing.T) {
+	cases := []struct {
+		raw                 string
+		major, minor, patch int
+		mariadb             bool
+		statusSQL           string
+		flavor              string
+	}{
+		{"8.0.36", 8, 0, 36, false, showMasterStatusSQL, mysql.MySQLFlavor},
+		{"8.2.0", 8, 2, 0, false, showBinaryLogStatusSQL, mysql.MySQLFlavor},
+		{"8.4.0-commercial", 8, 4, 0, false, showBinaryLogStatusSQL, mysql.MySQLFlavor},
+		{"10.11.6-MariaDB-log", 10, 11, 6, true, showMasterStatusSQL, mysql.MariaDBFlavor},
+		{"5.7.44-log", 5, 7, 44, false, showMasterStatusSQL, mysql.MySQLFlavor},
+	}
+	for _, c := range cases {
+		v := parseServerVersion(c.raw)
+		if v.major != c.major || v.minor != c.minor || v.patch != c.patch || v.mariadb != c.mariadb {
+			t.Errorf("parseServerVersion(%q) = %d.%d.%d mariadb=%t, want %d.%d.%d mariadb=%t",
+				c.raw, v.major, v.minor, v.patch, v.mariadb, c.major, c.minor, c.patch, c.mariadb)
+		}
+		if got := v.binlogStatusSQL(); got != c.statusSQL {
+			t.Errorf("binlogStatusSQL of %q = %q, want %q", c.raw, got, c.statusSQL)
+		}
+		if got := v.flavor(); got != c.flavor {
+			t.Errorf("flavor of %q = %q, want %q", c.raw, got, c.flavor)
+		}
+	}
+}
+
+func TestServerVersionAtLeast(t *testing.T) {
+	v := parseServerVersion("8.0.36")
+	for _, c := range []struct {
+		major, minor, patch int
+		want                bool
+	}{
+		{8, 0, 36, true}, {8, 0, 20, true}, {5, 7, 99, true}, {8, 0, 37, false}, {8, 2, 0, false}, {9, 0, 0, false},
+	} {
+		if got := v.atLeast(c.major, c.minor, c.patch); got != c.want {
+			t.Errorf("8.0.36 atLeast(%d, %d, %d) = %t, want %t", c.major, c.minor, c.patch, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package mysqlbinlog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/sirupsen/logrus"
+)
+
+// Session tracks the binlog of one MySQL server and rolls back the changes made on it.
+// Several sessions can live in one process, each one bound to its own server.
+type Session struct {
+	conf         *ConfCmd
+	version      serverVersion
+	sqlCon       *sql.DB // binlog disabled, used to query schemas and execute rollback SQLs
+	markerSqlCon *sql.DB // binlog enabled, used to insert markers
+	schemaOnly   bool    // only reads schemas, sqlCon is left as connected
+	tableinfo    tablesColumnsInfo
+	eventChan    chan myBinEvent
+	rollbackSQL  *RollbackSQL
+	journal      *journal         // nil without WithJournal
+	definitions  tableDefinitions // SHOW CREATE TABLE of the tables by binlog position, only with WithDDLRollback
+
+	markerSession string // session column of the markers inserted by the session, the marker table is shared
+
+	errOnce sync.Once
+	err     error         // sticky error of the background listener and generator
+	done    chan struct{} // closed when err is set
+
+	posMu   sync.Mutex
+	lastPos mysql.Position // position of the last binlog event received by the listener
+	gtidSet mysql.GTIDSet  // GTIDs received by the listener, nil if the server runs without gtid_mode
+
+	cycleMu sync.Mutex        // serializes Begin, Checkpoint and Rollback
+	frames  []*cycleFrame     // frames[0] is started by Begin, the others by checkpoints
+	scopes  map[uint32]*Scope // thread id => the scope owning the connection
+
+	beginChecksums   map[string]tableChecksum // db.table => checksum taken at Begin, only with WithVerify
+	lastVerifyReport *VerifyReport
+
+	shadows map[string]*shadowTable  // db.table => copy taken at Begin, only with WithShadowSnapshots
+	touched map[string]tableChecksum // db.table => tables changed by the cycles, copied and checksummed at Begin
+
+	ctx      context.Context // cancelled by Stop to shut down the listener and generator
+	cancel   context.CancelFunc
+	syncer   *replication.BinlogSyncer
+	wg       sync.WaitGroup // waits for the listener and generator
+	stopOnce sync.Once
+
+	reconnects int64 // resumed binlog streams, accessed atomically
+}
+
+// NewSession connects to the MySQL server, loads table schemas and starts to listen its binlog.
+func NewSession(host string, port uint, user string, password string, opts ...Option) (*Session, error) {
+	conf := newConfCmd(host, port, user, password, opts...)
+	if conf.SchemaFile != "" {
+		return nil, fmt.Errorf("schema snapshot %s is only supported by Flashback, a session reads schemas from the server", conf.SchemaFile)
+	}
+	if conf.GenMode != GenModeRollback {
+		return nil, fmt.Errorf("generation mode %d is only supported by Flashback, a session generates rollback SQLs", conf.GenMode)
+	}
+	if conf.BinlogTimeLocation == nil {
+		// this is to align datetime with DB config, or the rollback sql will have +8:00 offset
+		lo, err := time.LoadLocation("")
+		if err != nil {
+			return nil, fmt.Errorf("failed to load UTC timezone, err=%s", err.Error())
+		}
+		conf.BinlogTimeLocation = lo
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		conf:      conf,
+		eventChan: make(chan myBinEvent, 100),
+		rollbackSQL: &RollbackSQL{
+			sqls: make(chan rollbackEntry, 1000),
+			stop: ctx.Done(),
+		},
+		frames: []*cycleFrame{{}},
+		scopes: map[uint32]*Scope{},
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	if err := s.start(); err != nil {
+		s.Stop()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) start() error {
+	report, version, err := s.preflight()
+	if err != nil {
+		return err
+	}
+	if failed := report.Failed(); len(failed) > 0 {
+		return &PreflightError{Host: s.conf.Host, Port: s.conf.Port, Failed: failed}
+	}
+	s.version = version
+	if s.conf.Flavor == "" {
+		s.conf.Flavor = version.flavor()
+	}
+	logrus.Infof("server %s:%d version %s, using flavor %s", s.conf.Host, s.conf.Port, version.raw, s.conf.Flavor)
+
+	// this should happen before getTableInfo
+	if s.markerSession, err = newMarkerSession(); err != nil {
+		return err
+	}
+	if err := s.initMarkerDB(); err != nil {
+		return fmt.Errorf("failed to init marker db, err=%s", err.Error())
+	}
+
+	if err := s.getTableInfo(mysql.Position{}); err != nil {
+		return fmt.Errorf("failed to get table info, err=%s", err.Error())
+	}
+	if s.conf.DDLRollback {
+		if err := s.snapshotDDLTables(); err != nil {
+			return err
+		}
+	}
+
+	pos, gtidStr, err := s.getCurrentPosition()
+	if err != nil {
+		return fmt.Errorf("failed to get binlog current position, err=%s", err.Error())
+	}
+	if gtidStr != "" {
+		if s.gtidSet, err = mysql.ParseGTIDSet(s.conf.Flavor, gtidStr); err != nil {
+			return fmt.Errorf("failed to parse executed GTID set %s, err=%s", gtidStr, err.Error())
+		}
+	} else if s.conf.GTID {
+		return fmt.Errorf("GTID mode needs GTIDs enabled on server %s:%d, but its executed GTID set is empty", s.conf.Host, s.conf.Port)
+	}
+
+	if s.conf.JournalPath != "" {
+		if s.journal, err = s.openJournal(s.conf.JournalPath); err != nil {
+			return err
+		}
+	}
+
+	replStreamer, err := s.newBinlogStreamer(pos)
+	if err != nil {
+		return err
+	}
+
+	s.wg.Add(2)
+	go s.startListenBinEvents(replStreamer, pos)
+	go s.startGenRollbackSql()
+	return nil
+}
+
+// Err returns the error that stopped the background binlog listener or generator, nil if they are still running.
+// It is ErrStopped after Stop.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Done is closed when the background binlog listener or generator fails or the session is stopped, Err tells the reason.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) setErr(err error) {
+	s.errOnce.Do(func() {
+		logrus.Errorf("binlog pipeline of MySQL server %s:%d stopped, err=%s", s.conf.Host, s.conf.Port, err.Error())
+		s.err = err
+		close(s.done)
+	})
+}
+
+func (s *Session) setLastPos(pos mysql.Position) {
+	s.posMu.Lock()
+	defer s.posMu.Unlock()
+	s.lastPos = pos
+}
+
+// LastPosition returns the position of the last binlog event received by the listener.
+func (s *Session) LastPosition() mysql.Position {
+	s.posMu.Lock()
+	defer s.posMu.Unlock()
+	return s.lastPos
+}
+
+func (s *Session) addGTID(gtid string) error {
+	s.posMu.Lock()
+	defer s.posMu.Unlock()
+	if s.gtidSet == nil {
+		return nil
+	}
+	return s.gtidSet.Update(gtid)
+}
+
+func (s *Session) cloneGTIDSet() mysql.GTIDSet {
+	s.posMu.Lock()
+	defer s.posMu.Unlock()
+	return s.gtidSet.Clone()
+}
+
+// LastGTIDSet returns the executed GTID set up to the last transaction received by the listener,
+// empty if the server runs without gtid_mode.
+func (s *Session) LastGTIDSet() string {
+	s.posMu.Lock()
+	defer s.posMu.Unlock()
+	if s.gtidSet == nil {
+		return ""
+	}
+	return s.gtidSet.String()
+}
+
+// Begin starts a new rollback cycle, changes collected before it are discarded.
+func (s *Session) Begin() error {
+	return s.BeginContext(context.Background())
+}
+
+// BeginContext is Begin with a context to bound the wait for the marker.
+func (s *Session) BeginContext(ctx context.Context) error {
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	markerID, err := s.syncMarker(ctx)
+	if err != nil {
+		return err
+	}
+
+	discarded := s.frameEntries(0)
+	sqls := collectRollbackSQL(discarded, &s.tableinfo)
+	s.frames = []*cycleFrame{{}}
+	var autoIncrements map[string]uint64
+	if s.journal != nil {
+		autoIncrements = s.autoIncrements()
+	}
+	if err := s.journal.begin(markerID, s.LastPosition().String(), s.LastGTIDSet(), autoIncrements, discarded); err != nil {
+		return err
+	}
+	if len(sqls) > 0 {
+		logrus.Warnf("starting a new rollback cycle with markerID=%d, the already collected SQLs below will be discarded(%s)", markerID, strings.Join(sqls, ";\n"))
+	} else {
+		logrus.Infof("starting a new rollback cycle with markerID=%d", markerID)
+	}
+	s.noteTouched(discarded)
+	if err := s.takeShadowSnapshots(ctx, discarded); err != nil {
+		return s.wrapCtxErr(ctx, markerID, err)
+	}
+
+	if s.conf.Verify {
+		checksums, err := s.checksumTables(ctx, s.verifyTables())
+		if err != nil {
+			s.beginChecksums = nil
+			return s.wrapCtxErr(ctx, markerID, fmt.Errorf("failed to checksum tables for verification, err=%w", err))
+		}
+		s.beginChecksums = checksums
+	}
+	return nil
+}
+
+// Rollback reverts all changes made since the last Begin.
+func (s *Session) Rollback() error {
+	return s.RollbackContext(context.Background())
+}
+
+// RollbackContext is Rollback with a context to bound the wait for the marker and the execution of rollback SQLs.
+func (s *Session) RollbackContext(ctx context.Context) error {
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	markerID, err := s.syncMarker(ctx)
+	if err != nil {
+		return err
+	}
+
+	entries := s.frameEntries(0)
+	execErr := s.execRollback(ctx, markerID, entries, true)
+	if !isIrreversible(execErr) {
+		return execErr
+	}
+	s.frames = []*cycleFrame{{}}
+	if err := s.journal.done(entries); err != nil {
+		return fmt.Errorf("rollback executed, but failed to record it in the journal, err=%w", err)
+	}
+
+	if s.conf.Verify && s.beginChecksums != nil {
+		if err := s.verify(ctx, markerID, entries); err != nil {
+			// the DDL left behind is reported too
+			var verifyErr *VerifyError
+			if errors.As(err, &verifyErr) {
+				errors.As(execErr, &verifyErr.Irreversible)
+			}
+			return err
+		}
+	}
+	return execErr
+}
+
+// isIrreversible tells if err of execRollback is nil or only reports DDL left behind, the rollback is done then
+func isIrreversible(err error) bool {
+	var irreversible *IrreversibleDDLError
+	return err == nil || errors.As(err, &irreversible)
+}
+
+// noteTouched adds the tables of entries to the tables copied and checksummed at Begin
+func (s *Session) noteTouched(entries []rollbackEntry) {
+	if s.touched == nil {
+		s.touched = map[string]tableChecksum{}
+	}
+	for _, entry := range entries {
+		if entry.Table == "" || entry.DB == markerDatabaseName || entry.DB == shadowDatabaseName {
+			continue
+		}
+		s.touched[getTableName(entry.DB, entry.Table)] = tableChecksum{db: entry.DB, table: entry.Table}
+	}
+}
+
+// cycleTables returns the tables touched by the cycles so far and tables, given as db.table, sorted
+func (s *Session) cycleTables(tables []string) []tableChecksum {
+	all := map[string]tableChecksum{}
+	for key, tb := range s.touched {
+		all[key] = tb
+	}
+	for _, key := range tables {
+		if parts := strings.SplitN(key, ".", 2); len(parts) == 2 {
+			all[key] = tableChecksum{db: parts[0], table: parts[1]}
+		}
+	}
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]tableChecksum, len(keys))
+	for i, key := range keys {
+		result[i] = all[key]
+	}
+	return result
+}
+
+// execRollback executes the rollback SQLs of entries one by one in a transaction, then resets
+// the auto increment ids after the commit. Binlog is disabled on the connection so the rollback
+// itself is not collected. DDL commits implicitly, so the transaction is committed before each one.
+// DDL which can not be reverted is reported by an *IrreversibleDDLError once the rest is done.
+// full tells if entries go back to Begin, the tables wiped since then are restored from their shadow snapshots.
+func (s *Session) execRollback(ctx context.Context, markerID int64, entries []rollbackEntry, full bool) (err error) {
+	kept, changes, resets, restored := s.rollbackStatements(entries, full)
+	defer func() {
+		s.noteTouched(entries)
+		s.updateShadows(entries, restored, isIrreversible(err))
+	}()
+
+	var irreversibleErr error
+	if stmts := irreversibleStatements(kept); len(stmts) > 0 {
+		irreversibleErr = &IrreversibleDDLError{MarkerID: markerID, Statements: stmts}
+	}
+	if len(changes)+len(resets) == 0 {
+		logrus.Infof("no rollback SQLs to execute, markerID=%d", markerID)
+		return irreversibleErr
+	}
+
+	db, err := s.getDBCon()
+	if err != nil {
+		return err
+	}
+	// session variables only stick to one connection of the pool, so pin one
+	con, err := db.Conn(ctx)
+	if err != nil {
+		return s.wrapCtxErr(ctx, markerID, fmt.Errorf("failed to get connection, err=%w", err))
+	}
+	defer con.Close()
+	if _, err := con.ExecContext(ctx, disableBinlogSQL); err != nil {
+		return s.wrapCtxErr(ctx, markerID, fmt.Errorf("failed to disable binlog, err=%w", err))
+	}
+	if _, err := con.ExecContext(ctx, disableKeyCheckSQL); err != nil {
+		return s.wrapCtxErr(ctx, markerID, fmt.Errorf("failed to disable foreign key check, err=%w", err))
+	}
+
+	total := len(changes) + len(resets)
+	var (
+		tx        *sql.Tx
+		committed bool // DDL before the failing statement committed the ones before it
+	)
+	for i, stmt := range changes {
+		if stmt.Type == SQLTypeDDL {
+			if tx != nil {
+				if err := tx.Commit(); err != nil {
+					return s.wrapCtxErr(ctx, markerID, fmt.Errorf("failed to commit rollback transaction, markerID=%d err=%w", markerID, err))
+				}
+				tx = nil
+			}
+			committed = true
+			if _, err := con.ExecContext(ctx, stmt.SQL); err != nil {
+				return s.wrapCtxErr(ctx, markerID, &RollbackError{MarkerID: markerID, Index: i, Total: total, Statement: stmt, Committed: i > 0, Err: err})
+			}
+			logrus.Debugf("rollback DDL executed: %s", stmt.SQL)
+			continue
+		}
+		if tx == nil {
+			if tx, err = con.BeginTx(ctx, nil); err != nil {
+				return s.wrapCtxErr(ctx, markerID, fmt.Errorf("failed to begin rollback transaction, err=%w", err))
+			}
+		}
+		if _, err := tx.ExecContext(ctx, stmt.SQL); err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				logrus.Errorf("failed to roll back the rollback transaction, markerID=%d err=%s", markerID, rbErr.Error())
+			}
+			return s.wrapCtxErr(ctx, markerID, &RollbackError{MarkerID: markerID, Index: i, Total: total, Statement: stmt, Committed: committed, Err: err})
+		}
+		logrus.Debugf("rollback SQL executed: %s", stmt.SQL)
+	}
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return s.wrapCtxErr(ctx, markerID, fmt.Errorf("failed to commit rollback transaction, markerID=%d err=%w", markerID, err))
+		}
+	}
+
+	for i, stmt := range resets {
+		if _, err := con.ExecContext(ctx, stmt.SQL); err != nil {
+			return s.wrapCtxErr(ctx, markerID, &RollbackError{MarkerID: markerID, Index: len(changes) + i, Total: total, Statement: stmt, Committed: true, Err: err})
+		}
+		logrus.Debugf("rollback SQL executed: %s", stmt.SQL)
+	}
+	logrus.Infof("rollback executed successfully, markerID=%d, sql count=%d", markerID, total)
+	return irreversibleErr
+}
+
+// rollbackStatements returns the statements execRollback executes for entries in this order: the changes
+// reverted latest first, the restores from shadow snapshots, then the auto increment resets. The entries
+// left to revert, without the restored tables, and the restored tables are returned too.
+func (s *Session) rollbackStatements(entries []rollbackEntry, full bool) ([]rollbackEntry, []RollbackStatement, []RollbackStatement, map[string]bool) {
+	kept, restores, restored := s.shadowRestores(entries, full)
+	changes, resets := splitRollbackStatements(kept, &s.tableinfo)
+	return kept, append(changes, restores...), resets, restored
+}
+
+// syncMarker inserts a marker and waits for it in the binlog, the changes collected
+// before the marker are appended to the scope owning the connection, or to the innermost frame
+func (s *Session) syncMarker(ctx context.Context) (int64, error) {
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+
+	markerID, err := s.insertMarkerID(ctx)
+	if err != nil {
+		return markerID, s.wrapCtxErr(ctx, markerID, fmt.Errorf("failed to insert marker id, err=%w", err))
+	}
+
+	entries, err := s.rollbackSQL.collectRollbackEntries(ctx, markerID)
+	if err != nil {
+		// prefer the sticky pipeline error, it tells why the marker never came
+		if pipelineErr := s.Err(); pipelineErr != nil {
+			return markerID, pipelineErr
+		}
+		return markerID, s.wrapCtxErr(ctx, markerID, err)
+	}
+	top := s.frames[len(s.frames)-1]
+	for _, entry := range entries {
+		if scope, ok := s.scopes[entry.ThreadID]; ok {
+			scope.entries = append(scope.entries, entry)
+			continue
+		}
+		top.entries = append(top.entries, entry)
+	}
+	return markerID, nil
+}
+
+// wrapCtxErr turns err into a TimeoutError if it is caused by ctx
+func (s *Session) wrapCtxErr(ctx context.Context, markerID int64, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		return &TimeoutError{MarkerID: markerID, LastPos: s.LastPosition(), LastGTIDSet: s.LastGTIDSet(), Err: ctxErr}
+	}
+	return err
+}
+
+// Stop shuts down the binlog listener and generator and waits for them to exit,
+// then removes its markers and closes all connections to the MySQL server.
+// A stopped session can not be used anymore, create a new one instead.
+func (s *Session) Stop() {
+	stopped := false
+	s.stopOnce.Do(func() {
+		s.stop()
+		stopped = true
+	})
+	if !stopped {
+		logrus.Infof("session of MySQL server %s:%d is already stopped", s.conf.Host, s.conf.Port)
+	}
+}
+
+func (s *Session) stop() {
+	s.cancel()
+	s.wg.Wait()
+	s.journal.close()
+	if s.syncer != nil {
+		s.syncer.Close()
+		s.syncer = nil
+	}
+	s.errOnce.Do(func() {
+		s.err = ErrStopped
+		close(s.done)
+	})
+
+	if s.markerSqlCon != nil {
+		if err := s.markerSqlCon.Close(); err != nil {
+			logrus.Errorf("failed to close marker connection, err=%s", err.Error())
+		}
+		s.markerSqlCon = nil
+	}
+
+	if s.sqlCon != nil {
+		// Clean up marker table
+		if err := s.removeMarkers(); err != nil {
+			logrus.Errorf("failed to remove markers, err=%s", err.Error())
+		}
+		if s.conf.Shadow {
+			if err := s.dropShadowDB(); err != nil {
+				logrus.Errorf("failed to drop shadow db, err=%s", err.Error())
+			}
+		}
+		// Close the connection
+		logrus.Infof("closing connection to MySQL server %s:%d", s.conf.Host, s.conf.Port)
+		if err := s.sqlCon.Close(); err != nil {
+			logrus.Errorf("failed to close connection, err=%s", err.Error())
+		} else {
+			logrus.Infof("connection to MySQL server %s:%d closed", s.conf.Host, s.conf.Port)
+		}
+		s.sqlCon = nil
+	} else {
+		logrus.Infof("no connection to close, MySQL server %s:%d", s.conf.Host, s.conf.Port)
+	}
+}
+
+func (s *Session) insertMarkerID(ctx context.Context) (int64, error) {
+	con, err := s.getMarkerDBCon()
+	if err != nil {
+		return 0, err
+	}
+	// 1. Insert marker and get its id
+	res, err := con.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (session) VALUES (?);", markerDatabaseTableFullName), s.markerSession)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert marker: %w", err)
+	}
+	markerID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get marker id: %s", err.Error())
+	}
+	return markerID, nil
+}
+
+// PreviewRollback returns the statements Rollback would execute now without executing them,
+// the changes stay queued for the next Rollback.
+func (s *Session) PreviewRollback() ([]RollbackStatement, error) {
+	return s.PreviewRollbackContext(context.Background())
+}
+
+// PreviewRollbackContext is PreviewRollback with a context to bound the wait for the marker.
+func (s *Session) PreviewRollbackContext(ctx context.Context) ([]RollbackStatement, error) {
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	if _, err := s.syncMarker(ctx); err != nil {
+		return nil, err
+	}
+	_, changes, resets, _ := s.rollbackStatements(s.frameEntries(0), true)
+	return append(changes, resets...), nil
+}
@@ -0,0 +1,246 @@
+package mysqlbinlog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// TRUNCATE TABLE and DROP TABLE are logged as statements, the rows they remove are not in the binlog.
+// With WithShadowSnapshots, Begin copies the tables touched by the test cases into the shadow schema,
+// and Rollback restores a truncated or dropped table from its copy instead of reverting its rows.
+// A successful Rollback brings the tables back to their state at Begin, so a copy stays valid over
+// the following cycles, until the table is changed outside of a cycle or by DDL left behind.
+
+// shadowTable is the copy of a table at Begin
+type shadowTable struct {
+	name      string // table in the shadow schema
+	createSQL string // SHOW CREATE TABLE of the original one
+	columns   []string
+}
+
+// shadowTableName names the copy of db.tb, MySQL allows 64 characters
+func shadowTableName(db, tb string) string {
+	name := db + "__" + tb
+	if len(name) > 64 {
+		name = fmt.Sprintf("%s_%08x", name[:55], crc32.ChecksumIEEE([]byte(getTableName(db, tb))))
+	}
+	return name
+}
+
+// wipedTables returns the tables whose rows are removed by the DDL statements, as db, table
+func (s *Session) wipedTables(stmts []ast.StmtNode, schema string, before mysql.Position) [][2]string {
+	var tables [][2]string
+	for _, stmt := range stmts {
+		switch st := stmt.(type) {
+		case *ast.TruncateTableStmt:
+			db, tb := tableOf(st.Table, schema)
+			tables = append(tables, [2]string{db, tb})
+		case *ast.DropTableStmt:
+			if st.IsView {
+				continue
+			}
+			for _, tn := range st.Tables {
+				db, tb := tableOf(tn, schema)
+				tables = append(tables, [2]string{db, tb})
+			}
+		case *ast.DropDatabaseStmt:
+			for _, tb := range s.tableinfo.tablesIn(st.Name, before) {
+				tables = append(tables, [2]string{st.Name, tb})
+			}
+		}
+	}
+	return tables
+}
+
+// takeShadowSnapshots copies the touched tables which have no valid copy, the caller must hold cycleMu.
+// discarded are the changes made outside of a cycle, they outdate the copies of their tables.
+func (s *Session) takeShadowSnapshots(ctx context.Context, discarded []rollbackEntry) error {
+	if !s.conf.Shadow {
+		return nil
+	}
+	if s.shadows == nil {
+		s.shadows = map[string]*shadowTable{}
+	}
+	for _, entry := range discarded {
+		delete(s.shadows, getTableName(entry.DB, entry.Table))
+	}
+
+	var con *sql.Conn
+	defer func() {
+		if con != nil {
+			con.Close()
+		}
+	}()
+	for _, tb := range s.cycleTables(s.conf.ShadowTables) {
+		key := getTableName(tb.db, tb.table)
+		if _, ok := s.shadows[key]; ok {
+			continue
+		}
+		if con == nil {
+			var err error
+			if con, err = s.shadowConn(ctx); err != nil {
+				return err
+			}
+		}
+		shadow, err := s.snapshotShadow(ctx, con, tb.db, tb.table)
+		if err != nil {
+			return err
+		}
+		if shadow != nil {
+			s.shadows[key] = shadow
+		}
+	}
+	return nil
+}
+
+// shadowConn pins a connection with binlog disabled, the copies must not come back as changes to roll back
+func (s *Session) shadowConn(ctx context.Context) (*sql.Conn, error) {
+	db, err := s.getDBCon()
+	if err != nil {
+		return nil, err
+	}
+	// session variables only stick to one connection of the pool
+	con, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection, err=%w", err)
+	}
+	if _, err := con.ExecContext(ctx, disableBinlogSQL); err != nil {
+		con.Close()
+		return nil, fmt.Errorf("failed to disable binlog, err=%w", err)
+	}
+	return con, nil
+}
+
+// snapshotShadow copies db.tb into the shadow schema, nil if the table does not exist
+func (s *Session) snapshotShadow(ctx context.Context, con *sql.Conn, db, tb string) (*shadowTable, error) {
+	createSQL, err := s.showCreateTable(db, tb)
+	if err != nil {
+		logrus.Infof("no shadow snapshot of %s, err=%s", getTableName(db, tb), err.Error())
+		return nil, nil
+	}
+
+	rows, err := con.QueryContext(ctx, shadowColumnsSQL, db, tb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get columns of %s, err=%w", getTableName(db, tb), err)
+	}
+	shadow := &shadowTable{name: shadowTableName(db, tb), createSQL: createSQL}
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		shadow.columns = append(shadow.columns, quoteIdent(col))
+	}
+	rows.Close()
+
+	cols := strings.Join(shadow.columns, ", ")
+	for _, query := range []string{
+		"CREATE DATABASE IF NOT EXISTS " + quoteIdent(shadowDatabaseName),
+		"DROP TABLE IF EXISTS " + quoteName(shadowDatabaseName, shadow.name),
+		fmt.Sprintf("CREATE TABLE %s LIKE %s", quoteName(shadowDatabaseName, shadow.name), quoteName(db, tb)),
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quoteName(shadowDatabaseName, shadow.name), cols, cols, quoteName(db, tb)),
+	} {
+		if _, err := con.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to take shadow snapshot of %s, sql=%q err=%w", getTableName(db, tb), query, err)
+		}
+	}
+	logrus.Infof("shadow snapshot of %s taken", getTableName(db, tb))
+	return shadow, nil
+}
+
+// shadowRestores takes the entries of the tables truncated or dropped in entries out, and returns the
+// statements restoring those tables from their copies instead, with the tables restored. Only a full
+// Rollback restores them, the copies hold the state at Begin. Wiped tables which can not be restored
+// are made irreversible entries, so that the loss is reported.
+func (s *Session) shadowRestores(entries []rollbackEntry, full bool) ([]rollbackEntry, []RollbackStatement, map[string]bool) {
+	if !s.conf.Shadow {
+		return entries, nil, nil
+	}
+	restored := map[string]bool{}
+	var wipes []rollbackEntry
+	checked := make([]rollbackEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Wiped {
+			key := getTableName(entry.DB, entry.Table)
+			if _, ok := s.shadows[key]; !ok {
+				entry.Wiped = false
+				entry.Irreversible = fmt.Sprintf("rows of %s removed by it can not be restored, there is no shadow snapshot", key)
+			} else if !full {
+				entry.Wiped = false
+				entry.Irreversible = fmt.Sprintf("rows of %s removed by it are only restored by a full Rollback, the shadow snapshot is taken at Begin", key)
+			} else if !restored[key] {
+				restored[key] = true
+				wipes = append(wipes, entry)
+			}
+			if entry.Irreversible != "" {
+				logrus.Warnf("%q at %s: %s", entry.Query, entry.Pos, entry.Irreversible)
+			}
+		}
+		checked = append(checked, entry)
+	}
+	if len(restored) == 0 {
+		return checked, nil, restored
+	}
+
+	var kept []rollbackEntry
+	for _, entry := range checked {
+		if !restored[getTableName(entry.DB, entry.Table)] {
+			kept = append(kept, entry)
+		}
+	}
+	var restores []RollbackStatement
+	for _, wipe := range wipes {
+		shadow := s.shadows[getTableName(wipe.DB, wipe.Table)]
+		cols := strings.Join(shadow.columns, ", ")
+		for _, query := range []string{
+			"CREATE DATABASE IF NOT EXISTS " + quoteIdent(wipe.DB),
+			"DROP TABLE IF EXISTS " + quoteName(wipe.DB, wipe.Table),
+			createTableAs(shadow.createSQL, wipe.DB, wipe.Table),
+			fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quoteName(wipe.DB, wipe.Table), cols, cols, quoteName(shadowDatabaseName, shadow.name)),
+		} {
+			stmt := wipe.statement()
+			stmt.SQL, stmt.Type = query, SQLTypeDDL
+			restores = append(restores, stmt)
+		}
+		logrus.Infof("table %s is restored from its shadow snapshot", getTableName(wipe.DB, wipe.Table))
+	}
+	return kept, restores, restored
+}
+
+// updateShadows drops the copies outdated by a rollback of entries:
+// all of them if it failed, else those of the tables changed by DDL and not restored from them
+func (s *Session) updateShadows(entries []rollbackEntry, restored map[string]bool, ok bool) {
+	if !s.conf.Shadow || s.shadows == nil {
+		return
+	}
+	if !ok {
+		s.shadows = map[string]*shadowTable{}
+		return
+	}
+	for _, entry := range entries {
+		key := getTableName(entry.DB, entry.Table)
+		if entry.SqlType == SQLTypeDDL && !restored[key] {
+			delete(s.shadows, key)
+		}
+	}
+}
+
+func (s *Session) dropShadowDB() error {
+	con, err := s.shadowConn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+	if _, err := con.ExecContext(context.Background(), "DROP DATABASE IF EXISTS "+quoteIdent(shadowDatabaseName)); err != nil {
+		return fmt.Errorf("failed to drop shadow database: %s", err.Error())
+	}
+	return nil
+}
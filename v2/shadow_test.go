@@ -0,0 +1,160 @@
+package mysqlbinlog
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func tableName(db, tb string) *ast.TableName {
+	return &ast.TableName{Schema: model.CIStr{O: db, L: strings.ToLower(db)}, Name: model.CIStr{O: tb, L: strings.ToLower(tb)}}
+}
+
+func TestTruncateIsDDL(t *testing.T) {
+	for _, query := range []string{"TRUNCATE TABLE t", "  truncate t", "Truncate table `db`.`t`"} {
+		if !isDDL(query) {
+			t.Errorf("isDDL(%q) = false, want true", query)
+		}
+	}
+	if isDDL("INSERT INTO t VALUES (1)") {
+		t.Error("isDDL of an INSERT = true, want false")
+	}
+}
+
+func TestWipedTables(t *testing.T) {
+	s := &Session{}
+	stmts := []ast.StmtNode{
+		&ast.TruncateTableStmt{Table: tableName("", "orders")},
+		&ast.DropTableStmt{Tables: []*ast.TableName{tableName("shop", "items"), tableName("", "tmp")}},
+		&ast.DropTableStmt{Tables: []*ast.TableName{tableName("shop", "v")}, IsView: true},
+	}
+	got := s.wipedTables(stmts, "shop", mysql.Position{})
+	want := [][2]string{{"shop", "orders"}, {"shop", "items"}, {"shop", "tmp"}}
+	if len(got) != len(want) {
+		t.Fatalf("wipedTables = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("wipedTables[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestTruncateQueuesWipedEntry(t *testing.T) {
+	s := &Session{
+		conf:        &ConfCmd{Shadow: true},
+		rollbackSQL: &RollbackSQL{sqls: make(chan rollbackEntry, 4)},
+	}
+	ev := myBinEvent{
+		MyPos: mysql.Position{Name: "binlog.000001", Pos: 200}, StartPos: 100, Query: "TRUNCATE TABLE orders", SqlType: SQLTypeDDL,
+		DDL: &ddlEvent{Schema: "shop", Stmts: []ast.StmtNode{&ast.TruncateTableStmt{Table: tableName("", "orders")}}},
+	}
+	if err := s.genDDLRollback(ev); err != nil {
+		t.Fatal(err)
+	}
+	close(s.rollbackSQL.sqls)
+	var entries []rollbackEntry
+	for entry := range s.rollbackSQL.sqls {
+		entries = append(entries, entry)
+	}
+	if len(entries) != 1 || !entries[0].Wiped || entries[0].DB != "shop" || entries[0].Table != "orders" {
+		t.Fatalf("entries = %+v, want one wiped entry of shop.orders", entries)
+	}
+	if changes, _ := splitRollbackStatements(entries, &s.tableinfo); len(changes) != 0 {
+		t.Errorf("wiped entry executes %+v, want nothing", changes)
+	}
+}
+
+func TestShadowRestores(t *testing.T) {
+	s := &Session{
+		conf: &ConfCmd{Shadow: true},
+		shadows: map[string]*shadowTable{
+			"shop.orders": {name: "shop__orders", createSQL: "CREATE TABLE `orders` (`id` int)", columns: []string{"`id`"}},
+		},
+	}
+	entries := []rollbackEntry{
+		{MarkerID: -1, SQL: "DELETE FROM `shop`.`orders` WHERE `id`=1", DB: "shop", Table: "orders", SqlType: SQLTypeInsert},
+		{MarkerID: -1, DB: "shop", Table: "orders", Query: "TRUNCATE TABLE orders", SqlType: SQLTypeDDL, Wiped: true},
+		{MarkerID: -1, SQL: "DELETE FROM `shop`.`items` WHERE `id`=1", DB: "shop", Table: "items", SqlType: SQLTypeInsert},
+		{MarkerID: -1, DB: "shop", Table: "items", Query: "TRUNCATE TABLE items", SqlType: SQLTypeDDL, Wiped: true},
+	}
+
+	kept, restores, restored := s.shadowRestores(entries, true)
+	if len(kept) != 2 || kept[0].Table != "items" || kept[1].Table != "items" {
+		t.Fatalf("kept = %+v, want the entries of shop.items", kept)
+	}
+	// shop.items has no snapshot, its TRUNCATE is reported instead of skipped
+	if kept[1].Wiped || !strings.Contains(kept[1].Irreversible, "no shadow snapshot") {
+		t.Errorf("TRUNCATE of a table without snapshot = %+v, want an irreversible entry", kept[1])
+	}
+	if stmts := irreversibleStatements(kept); len(stmts) != 1 || stmts[0].Query != "TRUNCATE TABLE items" {
+		t.Errorf("irreversible statements = %+v, want the TRUNCATE of shop.items", stmts)
+	}
+	if !entries[3].Wiped || entries[3].Irreversible != "" {
+		t.Error("shadowRestores changed the entries passed in")
+	}
+	if !restored["shop.orders"] || restored["shop.items"] {
+		t.Errorf("restored = %v, want shop.orders only", restored)
+	}
+	want := []string{
+		"CREATE DATABASE IF NOT EXISTS `shop`",
+		"DROP TABLE IF EXISTS `shop`.`orders`",
+		"INSERT INTO `shop`.`orders` (`id`) SELECT `id` FROM `_mysqlbinlog_shadow_db`.`shop__orders`",
+	}
+	if len(restores) != 4 || restores[0].SQL != want[0] || restores[1].SQL != want[1] || restores[3].SQL != want[2] {
+		t.Fatalf("restores = %+v, want %v around the CREATE TABLE", restores, want)
+	}
+	for _, stmt := range restores {
+		if stmt.Type != SQLTypeDDL || stmt.Query != "TRUNCATE TABLE orders" {
+			t.Errorf("restore %+v, want a DDL statement of the TRUNCATE", stmt)
+		}
+	}
+
+	// RollbackTo and scopes do not go back to Begin
+	kept, restores, _ = s.shadowRestores(entries, false)
+	if len(kept) != len(entries) || len(restores) != 0 {
+		t.Fatalf("partial rollback restores %+v, want nothing", restores)
+	}
+	if stmts := irreversibleStatements(kept); len(stmts) != 2 {
+		t.Errorf("irreversible statements of a partial rollback = %+v, want both TRUNCATEs", stmts)
+	}
+}
+
+func TestShadowTableName(t *testing.T) {
+	if got := shadowTableName("shop", "orders"); got != "shop__orders" {
+		t.Errorf("shadowTableName = %s, want shop__orders", got)
+	}
+	long := strings.Repeat("d", 40)
+	a, b := shadowTableName(long, strings.Repeat("t", 40)), shadowTableName(long, strings.Repeat("t", 41))
+	if len(a) > 64 || len(b) > 64 || a == b {
+		t.Errorf("shadowTableName of long names = %s, %s, want distinct names of 64 characters at most", a, b)
+	}
+}
+
+func TestRollbackStatementsOrder(t *testing.T) {
+	s := &Session{
+		conf: &ConfCmd{Shadow: true},
+		shadows: map[string]*shadowTable{
+			"shop.orders": {name: "shop__orders", createSQL: "CREATE TABLE `orders` (`id` int)", columns: []string{"`id`"}},
+		},
+	}
+	s.tableinfo.replace(map[string]*tblInfoJson{"shop.items": {AutoIncrement: 5}}, mysql.Position{})
+	entries := []rollbackEntry{
+		{MarkerID: -1, SQL: "DELETE FROM `shop`.`items` WHERE `id`=5", DB: "shop", Table: "items", SqlType: SQLTypeInsert},
+		{MarkerID: -1, DB: "shop", Table: "orders", Query: "TRUNCATE TABLE orders", SqlType: SQLTypeDDL, Wiped: true},
+	}
+
+	_, changes, resets, _ := s.rollbackStatements(entries, true)
+	var got []string
+	for _, stmt := range append(changes, resets...) {
+		got = append(got, stmt.DB+"."+stmt.Table+" "+stmt.SQL[:strings.Index(stmt.SQL, " ")])
+	}
+	// the order RollbackError.Index counts in
+	want := []string{"shop.items DELETE", "shop.orders CREATE", "shop.orders DROP", "shop.orders CREATE", "shop.orders INSERT", "shop.items ALTER"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("statements = %v, want %v", got, want)
+	}
+}
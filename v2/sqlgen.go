@@ -1,17 +1,30 @@
 package mysqlbinlog
 
 import (
+	"errors"
 	"fmt"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/manilion/godropbox/database/sqlbuilder"
 	SQL "github.com/manilion/godropbox/database/sqlbuilder"
+	"github.com/manilion/godropbox/database/sqltypes"
+	"github.com/shopspring/decimal"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
 	"github.com/sirupsen/logrus"
+	"reflect"
 	"strings"
 )
 
-func startGenRollbackSql() {
+func (s *Session) startGenRollbackSql() {
+	defer s.wg.Done()
+	// closing the queue lets a pending Begin/Rollback stop waiting for its marker
+	defer close(s.rollbackSQL.sqls)
+	if err := s.genRollbackSql(); err != nil {
+		s.setErr(err)
+	}
+}
+
+func (s *Session) genRollbackSql() error {
 	var (
 		err            error
 		tbInfo         *tblInfoJson
@@ -24,10 +37,17 @@ func startGenRollbackSql() {
 		uniqueKeyIdx   []int
 		uniqueKey      keyInfo
 		posStr         string
+		image1, image2 []bool
 	)
 	logrus.Info("start to generate rollback sql")
 
-	for ev := range eventChan {
+	for ev := range s.eventChan {
+		if ev.DDL != nil {
+			if err := s.genDDLRollback(ev); err != nil {
+				return err
+			}
+			continue
+		}
 		if !ev.IfRowsEvent {
 			continue
 		}
@@ -39,36 +59,47 @@ func startGenRollbackSql() {
 		fulltb = getTableName(db, tb)
 
 		var colsTypeNameFromMysql []string
+		fixUnsignedValues(ev.BinEvent)
+		// binlog_row_metadata=FULL tells the columns of the rows, the table structure loaded at Start() is the fallback
+		tbAtPos, _ := s.tableinfo.lookup(fulltb, ev.MyPos)
+		metaCols, metaKey := metadataColumns(ev.BinEvent.Table, tbAtPos)
 		canRetry := true
 		// Fix issue: can not find table or table fields if table structure changes during cases are running
 		for {
-			tbInfo, err = tableinfo.getTableInfo(db, tb, ev.MyPos.Name, ev.StartPos, ev.MyPos.Pos)
-			if err != nil {
-				logrus.Panicf("error to found %s table structure for event %s", fulltb, posStr)
-			}
-			// when new table added, we need to update the table defination via `getTableInfo` and retry
-			if tbInfo == nil {
-				msg := fmt.Sprintf("no suitable table struct found for %s for event %s", fulltb, posStr)
-
-				if !canRetry {
-					logrus.Panicf(msg)
+			if metaCols != nil {
+				allColNames, uniqueKey = metaCols, metaKey
+			} else {
+				tbInfo, err = s.tableinfo.getTableInfo(db, tb, ev.MyPos.Name, ev.StartPos, ev.MyPos.Pos)
+				if err != nil {
+					return fmt.Errorf("error to found %s table structure for event %s", fulltb, posStr)
 				}
+				// when new table added, we need to update the table defination via `getTableInfo` and retry
+				if tbInfo == nil {
+					msg := fmt.Sprintf("no suitable table struct found for %s for event %s", fulltb, posStr)
 
-				canRetry = false
-				if err = getTableInfo(); err != nil {
-					logrus.Panicf(err.Error())
+					if !canRetry {
+						return errors.New(msg)
+					}
+
+					canRetry = false
+					if err = s.getTableInfo(ev.MyPos); err != nil {
+						return err
+					}
+					continue
 				}
-				continue
-			}
 
-			colCnt = len(ev.BinEvent.Rows[0])
-			allColNames = getAllFieldNamesWithDroppedFields(colCnt, tbInfo.Columns)
+				colCnt = len(ev.BinEvent.Rows[0])
+				allColNames = getAllFieldNamesWithDroppedFields(colCnt, tbInfo.Columns)
+				uniqueKey = tbInfo.getOneUniqueKey()
+			}
+			image1, image2 = rowImagePresence(ev.BinEvent)
+			image1, image2 = filterStoredGeneratedPresence(allColNames, image1), filterStoredGeneratedPresence(allColNames, image2)
 			allColNames, ev.BinEvent.Rows = filterStoredGeneratedFields(allColNames, ev.BinEvent.Rows)
 
 			colCnt = len(ev.BinEvent.Rows[0])
 			colsDef, colsTypeName = getSqlFieldsExpressions(colCnt, allColNames, ev.BinEvent.Table)
 			colsTypeNameFromMysql = make([]string, len(colsTypeName))
-			if len(colsTypeName) <= len(tbInfo.Columns) {
+			if metaCols != nil || len(colsTypeName) <= len(tbInfo.Columns) {
 				break
 			}
 
@@ -77,29 +108,29 @@ func startGenRollbackSql() {
 				len(colsTypeName), len(tbInfo.Columns), fulltb, ev.MyPos.String(), spew.Sdump(tbInfo.Columns), spew.Sdump(ev.BinEvent.Rows[0]))
 
 			if !canRetry {
-				logrus.Panicf(msg)
+				return errors.New(msg)
 			}
 
 			canRetry = false
 			logrus.Info(msg)
-			if err = getTableInfo(); err != nil {
-				logrus.Panicf(err.Error())
+			if err = s.getTableInfo(ev.MyPos); err != nil {
+				return err
 			}
 		}
 
 		// convert blob type to string
 		for ci, colType := range colsTypeName {
-			colsTypeNameFromMysql[ci] = tbInfo.Columns[ci].FieldType
+			colsTypeNameFromMysql[ci] = allColNames[ci].FieldType
 			if colType == BLOB {
 				// text is stored as blob
-				if strings.Contains(strings.ToLower(tbInfo.Columns[ci].FieldType), "text") {
+				if strings.Contains(strings.ToLower(allColNames[ci].FieldType), "text") {
 					for ri := range ev.BinEvent.Rows {
 						if ev.BinEvent.Rows[ri][ci] == nil {
 							continue
 						}
 						txtStr, coOk := ev.BinEvent.Rows[ri][ci].([]byte)
 						if !coOk {
-							logrus.Panicf("fail to convert %s to []byte type", ev.BinEvent.Rows[ri][ci])
+							return fmt.Errorf("fail to convert %v to []byte type", ev.BinEvent.Rows[ri][ci])
 						} else {
 							ev.BinEvent.Rows[ri][ci] = string(txtStr)
 						}
@@ -107,7 +138,6 @@ func startGenRollbackSql() {
 				}
 			}
 		}
-		uniqueKey = tbInfo.getOneUniqueKey()
 		if len(uniqueKey) > 0 {
 			uniqueKeyIdx = getColIndexFromKey(uniqueKey, allColNames)
 		} else {
@@ -117,29 +147,41 @@ func startGenRollbackSql() {
 		if fulltb == markerDatabaseTableFullName {
 			if ev.SqlType == SQLTypeInsert {
 				if len(ev.BinEvent.Rows) != 1 {
-					logrus.Panicf("Error: marker table %s should only have one row inserted, but got %d at position %s", markerDatabaseTableFullName, len(ev.BinEvent.Rows), posStr)
+					return fmt.Errorf("marker table %s should only have one row inserted, but got %d at position %s", markerDatabaseTableFullName, len(ev.BinEvent.Rows), posStr)
 				}
 
-				markerID := ev.BinEvent.Rows[0][0].(int64)
-				rollbackSQL.appendMarker(markerID)
+				// other sessions on the server share the marker table
+				if markerID, ok := s.ownMarker(ev.BinEvent.Rows[0]); ok {
+					s.rollbackSQL.appendMarker(markerID)
+				}
 			} else {
 				logrus.Infof("Error: marker table %s should only be inserted, but got %v at position %s", markerDatabaseTableFullName, ev.SqlType, posStr)
 			}
 			continue
 		}
 
-		if ev.SqlType == SQLTypeInsert {
-			sqls = genDeleteSqls(posStr, ev.BinEvent, colsDef, uniqueKeyIdx, false, true)
-		} else if ev.SqlType == SQLTypeDelete {
-			sqls = genInsertSqls(posStr, ev.BinEvent, colsDef, 20, true)
-		} else if ev.SqlType == SQLTypeUpdate {
-			sqls = genUpdateSqls(posStr, colsTypeNameFromMysql, colsTypeName, ev.BinEvent, colsDef, uniqueKeyIdx, false, true)
-		} else {
+		forward := s.conf.GenMode == GenModeForward
+		var irreversible string
+		var ok bool
+		if !isFullImage(image1) || !isFullImage(image2) {
+			// binlog_row_image=MINIMAL or NOBLOB
+			if sqls, err = genPartialImageSqls(posStr, ev.SqlType, ev.BinEvent, colsDef, allColNames, uniqueKeyIdx, image1, image2, forward); err != nil {
+				// only the rollback of this cycle fails, reported by an *IrreversibleDDLError
+				logrus.Warnf("%s", err.Error())
+				irreversible, sqls = err.Error(), []string{""}
+			}
+		} else if sqls, ok = genFullImageSqls(posStr, ev.SqlType, ev.BinEvent, colsTypeNameFromMysql, colsTypeName, colsDef, uniqueKeyIdx, forward); !ok {
 			logrus.Infof("Warning: unsupported query type %d to generate rollback sql, it should one of insert|update|delete. %s", ev.SqlType, ev.MyPos.String())
 			continue
 		}
-		rollbackSQL.appendGeneralSQLs(sqls, db, tb)
+		src := rollbackEntry{DB: db, Table: tb, ThreadID: ev.ThreadID, GTID: ev.GTID, Query: ev.Query, Pos: posStr, SqlType: ev.SqlType, Irreversible: irreversible}
+		// journal first, a crash must not lose an entry the session may roll back
+		if err := s.journal.appendEntries(sqls, src); err != nil {
+			return err
+		}
+		s.rollbackSQL.appendGeneralSQLs(sqls, src)
 	}
+	return nil
 }
 
 func filterStoredGeneratedFields(names []fieldInfo, rows [][]interface{}) ([]fieldInfo, [][]interface{}) {
@@ -206,7 +248,8 @@ func getMysqlDataTypeNameAndSqlColumn(tpDef string, colName string, tp byte, met
 		return "bigint", sqlbuilder.IntColumn(colName, sqlbuilder.NotNullable)
 
 	case mysql.MYSQL_TYPE_NEWDECIMAL:
-		return "decimal", sqlbuilder.DoubleColumn(colName, sqlbuilder.NotNullable)
+		// the builder only writes the name of a column, the decimal.Decimal values are written by literal
+		return "decimal", sqlbuilder.BytesColumn(colName, sqlbuilder.NotNullable)
 
 	case mysql.MYSQL_TYPE_FLOAT:
 		return "float", sqlbuilder.DoubleColumn(colName, sqlbuilder.NotNullable)
@@ -286,17 +329,40 @@ func genEqualConditions(row []interface{}, colDefs []sqlbuilder.NonAliasColumn,
 	if !ifFullImage && len(uniKey) > 0 {
 		expArrs := make([]sqlbuilder.BoolExpression, len(uniKey))
 		for k, idx := range uniKey {
-			expArrs[k] = sqlbuilder.EqL(colDefs[idx], row[idx])
+			expArrs[k] = eqL(colDefs[idx], row[idx])
 		}
 		return expArrs
 	}
 	expArrs := make([]sqlbuilder.BoolExpression, len(row))
 	for i, v := range row {
-		expArrs[i] = sqlbuilder.EqL(colDefs[i], v)
+		expArrs[i] = eqL(colDefs[i], v)
 	}
 	return expArrs
 }
 
+// literal is sqlbuilder.Literal writing DECIMAL values as they are, unquoted: a string compared
+// with a DECIMAL column is converted to a double, and the builder has no decimal type
+func literal(v interface{}) sqlbuilder.Expression {
+	if d, ok := v.(decimal.Decimal); ok {
+		return sqlbuilder.Literal(sqltypes.MakeFractional([]byte(d.String())))
+	}
+	return sqlbuilder.Literal(v)
+}
+
+// equalValues compares two column values of a row, decimal.Decimal holds a *big.Int so == compares pointers
+func equalValues(a, b interface{}) bool {
+	if da, ok := a.(decimal.Decimal); ok {
+		db, ok := b.(decimal.Decimal)
+		return ok && da.Equal(db)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// eqL is sqlbuilder.EqL with literal
+func eqL(col sqlbuilder.NonAliasColumn, v interface{}) sqlbuilder.BoolExpression {
+	return sqlbuilder.Eq(col, literal(v))
+}
+
 func convertRowToExpressRow(row []interface{}, ifIgnorePrimary bool, primaryIdx []int) []sqlbuilder.Expression {
 	var valueInserted []sqlbuilder.Expression
 	for i, val := range row {
@@ -305,7 +371,7 @@ func convertRowToExpressRow(row []interface{}, ifIgnorePrimary bool, primaryIdx
 				continue
 			}
 		}
-		vExp := sqlbuilder.Literal(val)
+		vExp := literal(val)
 		valueInserted = append(valueInserted, vExp)
 	}
 	return valueInserted
@@ -406,7 +472,7 @@ func genUpdateSetPart(colsTypeNameFromMysql []string, colTypeNames []string, upd
 				}
 
 			} else {
-				if v == rowBefore[i] {
+				if equalValues(v, rowBefore[i]) {
 					ifUpdateCol = false
 				} else {
 					ifUpdateCol = true
@@ -417,7 +483,7 @@ func genUpdateSetPart(colsTypeNameFromMysql []string, colTypeNames []string, upd
 		}
 
 		if ifUpdateCol {
-			updateSql.Set(colDefs[i], sqlbuilder.Literal(v))
+			updateSql.Set(colDefs[i], literal(v))
 		}
 	}
 	return updateSql
@@ -456,6 +522,38 @@ func genUpdateSqls(posStr string, colsTypeNameFromMysql []string, colsTypeName [
 	return sqlArr
 }
 
+// genFullImageSqls generates the SQLs of a rows event with full row images, the rollback ones or the original
+// ones with forward, false if sqlType is not a rows change
+func genFullImageSqls(posStr string, sqlType SQLType, rEv *replication.RowsEvent, colsTypeNameFromMysql, colsTypeName []string,
+	colsDef []SQL.NonAliasColumn, uniqueKeyIdx []int, forward bool) ([]string, bool) {
+	switch {
+	case sqlType == SQLTypeInsert && forward:
+		return genInsertSqls(posStr, rEv, colsDef, 20, true), true
+	case sqlType == SQLTypeInsert:
+		return genDeleteSqls(posStr, rEv, colsDef, uniqueKeyIdx, false, true), true
+	case sqlType == SQLTypeDelete && forward:
+		return genDeleteSqls(posStr, rEv, colsDef, uniqueKeyIdx, false, true), true
+	case sqlType == SQLTypeDelete:
+		return genInsertSqls(posStr, rEv, colsDef, 20, true), true
+	case sqlType == SQLTypeUpdate && forward:
+		return genUpdateSqls(posStr, colsTypeNameFromMysql, colsTypeName, swapUpdateImages(rEv), colsDef, uniqueKeyIdx, false, true), true
+	case sqlType == SQLTypeUpdate:
+		return genUpdateSqls(posStr, colsTypeNameFromMysql, colsTypeName, rEv, colsDef, uniqueKeyIdx, false, true), true
+	}
+	return nil, false
+}
+
+// swapUpdateImages returns a copy of the update event with the before and after images of each row swapped,
+// so that genUpdateSqls generates the original update instead of the rollback one
+func swapUpdateImages(rEv *replication.RowsEvent) *replication.RowsEvent {
+	swapped := *rEv
+	swapped.Rows = make([][]interface{}, len(rEv.Rows))
+	for i := 0; i+1 < len(rEv.Rows); i += 2 {
+		swapped.Rows[i], swapped.Rows[i+1] = rEv.Rows[i+1], rEv.Rows[i]
+	}
+	return &swapped
+}
+
 func getPosStr(name string, spos uint32, epos uint32) string {
 	return fmt.Sprintf("%s %d-%d", name, spos, epos)
 }
@@ -0,0 +1,169 @@
+package mysqlbinlog
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/manilion/godropbox/database/sqlbuilder"
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// decimals as go-mysql decodes them with UseDecimal, up to DECIMAL(65,30),
+// val is the binlog value and want the literal, decimal drops the trailing zeros
+var decimalCases = []struct {
+	name string
+	val  string
+	want string
+}{
+	{"max precision", "12345678901234567890123456789012345.123456789012345678901234567891", "12345678901234567890123456789012345.123456789012345678901234567891"},
+	{"negative max precision", "-99999999999999999999999999999999999.999999999999999999999999999999", "-99999999999999999999999999999999999.999999999999999999999999999999"},
+	{"high scale", "0.000000000000000000000000000001", "0.000000000000000000000000000001"},
+	{"negative high scale", "-0.000000000000000000000000000009", "-0.000000000000000000000000000009"},
+	{"money", "1234567890123.100001", "1234567890123.100001"},
+	{"trailing zeros", "1234567890123.100000", "1234567890123.1"},
+	{"integer", "99999999999999999999999999999999999999999999999999999999999999999", "99999999999999999999999999999999999999999999999999999999999999999"},
+	{"zero", "0.000000", "0"},
+}
+
+func mustDecimal(t *testing.T, s string) decimal.Decimal {
+	t.Helper()
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		t.Fatalf("bad decimal %s: %s", s, err.Error())
+	}
+	return d
+}
+
+func serialize(t *testing.T, exp sqlbuilder.Expression) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := exp.SerializeSql(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func decimalRowsEvent(rows ...[]interface{}) *replication.RowsEvent {
+	return &replication.RowsEvent{
+		Table: &replication.TableMapEvent{Schema: []byte("db"), Table: []byte("t")},
+		Rows:  rows,
+	}
+}
+
+func decimalColumns() []sqlbuilder.NonAliasColumn {
+	_, id := getMysqlDataTypeNameAndSqlColumn("int", "id", mysql.MYSQL_TYPE_LONG, 0)
+	_, amount := getMysqlDataTypeNameAndSqlColumn("decimal(65,30)", "amount", mysql.MYSQL_TYPE_NEWDECIMAL, 0)
+	return []sqlbuilder.NonAliasColumn{id, amount}
+}
+
+func TestDecimalLiteral(t *testing.T) {
+	for _, tc := range decimalCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := mustDecimal(t, tc.val)
+			got := serialize(t, literal(d))
+			if got != tc.want {
+				t.Errorf("literal = %s, want %s", got, tc.want)
+			}
+			if back := mustDecimal(t, got); !back.Equal(d) {
+				t.Errorf("literal %s reads back as %s, want %s", got, back, tc.val)
+			}
+			cols := decimalColumns()
+			if got, want := serialize(t, eqL(cols[1], d)), "`amount`="+tc.want; got != want {
+				t.Errorf("eqL = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestDecimalRollbackSqls(t *testing.T) {
+	cols := decimalColumns()
+	for _, tc := range decimalCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := mustDecimal(t, tc.val)
+
+			// rollback of a delete
+			sqls := genInsertSqls("pos", decimalRowsEvent([]interface{}{int32(1), d}), cols, 20, true)
+			if want := "INSERT INTO `db`.`t` (`t`.`id`,`t`.`amount`) VALUES (1," + tc.want + ")"; len(sqls) != 1 || sqls[0] != want {
+				t.Errorf("insert = %q, want %q", sqls, want)
+			}
+
+			// rollback of an insert into a table without key
+			sqls = genDeleteSqls("pos", decimalRowsEvent([]interface{}{int32(1), d}), cols, []int{}, false, true)
+			if want := "DELETE FROM `db`.`t` WHERE (`t`.`id`=1 AND `t`.`amount`=" + tc.want + ")"; len(sqls) != 1 || sqls[0] != want {
+				t.Errorf("delete = %q, want %q", sqls, want)
+			}
+
+			// rollback of an update sets the before image back, where the after image
+			before, after := []interface{}{int32(1), d}, []interface{}{int32(1), mustDecimal(t, "7.5")}
+			sqls = genUpdateSqls("pos", []string{"int", "decimal(65,30)"}, []string{"int", "decimal"}, decimalRowsEvent(before, after), cols, []int{}, false, true)
+			if want := "UPDATE `db`.`t` SET `t`.`amount`=" + tc.want + " WHERE (`t`.`id`=1 AND `t`.`amount`=7.5)"; len(sqls) != 1 || sqls[0] != want {
+				t.Errorf("update = %q, want %q", sqls, want)
+			}
+		})
+	}
+}
+
+func TestDecimalUnchangedColumnNotSet(t *testing.T) {
+	cols := decimalColumns()
+	// decoded twice, the values hold different *big.Int
+	before := []interface{}{int32(1), mustDecimal(t, decimalCases[0].val)}
+	after := []interface{}{int32(2), mustDecimal(t, decimalCases[0].val)}
+	sqls := genUpdateSqls("pos", []string{"int", "decimal(65,30)"}, []string{"int", "decimal"}, decimalRowsEvent(before, after), cols, []int{0}, false, true)
+	if want := "UPDATE `db`.`t` SET `t`.`id`=1 WHERE `t`.`id`=2"; len(sqls) != 1 || sqls[0] != want {
+		t.Errorf("update = %q, want %q", sqls, want)
+	}
+}
+
+func TestGenFullImageSqls(t *testing.T) {
+	cols, _ := ordersColumns()
+	mysqlTypes, types := []string{"int", "varchar(64)", "int"}, []string{"int", "varchar", "int"}
+	row1, row2 := []interface{}{int32(1), "a", int32(3)}, []interface{}{int32(1), "b", int32(5)}
+	cases := []struct {
+		name    string
+		sqlType SQLType
+		rows    [][]interface{}
+		forward bool
+		want    string
+	}{
+		{"insert", SQLTypeInsert, [][]interface{}{row1}, false, "DELETE FROM `shop`.`orders` WHERE `orders`.`id`=1"},
+		{"insert forward", SQLTypeInsert, [][]interface{}{row1}, true, "INSERT INTO `shop`.`orders` (`orders`.`id`,`orders`.`note`,`orders`.`qty`) VALUES (1,'a',3)"},
+		{"delete", SQLTypeDelete, [][]interface{}{row1}, false, "INSERT INTO `shop`.`orders` (`orders`.`id`,`orders`.`note`,`orders`.`qty`) VALUES (1,'a',3)"},
+		{"delete forward", SQLTypeDelete, [][]interface{}{row1}, true, "DELETE FROM `shop`.`orders` WHERE `orders`.`id`=1"},
+		{"update", SQLTypeUpdate, [][]interface{}{row1, row2}, false, "UPDATE `shop`.`orders` SET `orders`.`note`='a', `orders`.`qty`=3 WHERE `orders`.`id`=1"},
+		{"update forward", SQLTypeUpdate, [][]interface{}{row1, row2}, true, "UPDATE `shop`.`orders` SET `orders`.`note`='b', `orders`.`qty`=5 WHERE `orders`.`id`=1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ev := ordersRowsEvent(tc.rows...)
+			sqls, ok := genFullImageSqls("pos", tc.sqlType, ev, mysqlTypes, types, cols, []int{0}, tc.forward)
+			if !ok || len(sqls) != 1 || sqls[0] != tc.want {
+				t.Errorf("sqls = %q, %t, want %q", sqls, ok, tc.want)
+			}
+			if tc.sqlType == SQLTypeUpdate && ev.Rows[0][1] != "a" {
+				t.Error("the event is changed, want the images swapped in a copy")
+			}
+		})
+	}
+
+	if _, ok := genFullImageSqls("pos", SQLTypeQuery, ordersRowsEvent(), mysqlTypes, types, cols, []int{0}, false); ok {
+		t.Error("genFullImageSqls of a query = true, want false")
+	}
+}
+
+func TestSwapUpdateImages(t *testing.T) {
+	ev := ordersRowsEvent([]interface{}{int32(1)}, []interface{}{int32(2)}, []interface{}{int32(3)}, []interface{}{int32(4)})
+	swapped := swapUpdateImages(ev)
+	var got []interface{}
+	for _, row := range swapped.Rows {
+		got = append(got, row[0])
+	}
+	if want := []interface{}{int32(2), int32(1), int32(4), int32(3)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("swapped rows = %v, want %v", got, want)
+	}
+	if ev.Rows[0][0] != int32(1) || swapped.Table != ev.Table {
+		t.Error("swapUpdateImages changed the event or dropped its table")
+	}
+}
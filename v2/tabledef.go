@@ -0,0 +1,229 @@
+package mysqlbinlog
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// With WithDDLRollback the SHOW CREATE TABLE of a table is needed to re-create it, or to rebuild it after
+// an ALTER TABLE without simple inverse. The generator runs behind the listener, which runs behind the server,
+// so a definition read when the generator reaches a DDL may hold later DDL already. The definitions are
+// versioned by binlog position instead: the listener records the DDL changing each table, and a definition
+// read between two binlog positions is the one in effect after them, until the next DDL on the table.
+
+// tableDefinition is a SHOW CREATE TABLE read between the binlog positions from and to, empty if the table is missing
+type tableDefinition struct {
+	from, to mysql.Position
+	sql      string
+}
+
+// tableDefinitions are the definitions of the tables, shared by the listener and the generator
+type tableDefinitions struct {
+	mu      sync.Mutex
+	changes map[string][]mysql.Position // db.table => ends of the DDL changing it, in binlog order
+	defs    map[string][]tableDefinition
+}
+
+// changed records a DDL ending at pos which changes the table
+func (d *tableDefinitions) changed(tbKey string, pos mysql.Position) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.changes == nil {
+		d.changes = map[string][]mysql.Position{}
+	}
+	d.changes[tbKey] = append(d.changes[tbKey], pos)
+}
+
+func (d *tableDefinitions) add(tbKey string, def tableDefinition) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.defs == nil {
+		d.defs = map[string][]tableDefinition{}
+	}
+	d.defs[tbKey] = append(d.defs[tbKey], def)
+}
+
+// lastChange returns the end of the last DDL changing the table up to pos, zero if none, mu must be held
+func (d *tableDefinitions) lastChange(tbKey string, pos mysql.Position) mysql.Position {
+	changes := d.changes[tbKey]
+	for i := len(changes) - 1; i >= 0; i-- {
+		if changes[i].Compare(pos) <= 0 {
+			return changes[i]
+		}
+	}
+	return mysql.Position{}
+}
+
+// at returns the definition of the table in effect at pos: read after the last DDL on it before pos,
+// and before pos, so no DDL changed it in between
+func (d *tableDefinitions) at(tbKey string, pos mysql.Position) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last := d.lastChange(tbKey, pos)
+	defs := d.defs[tbKey]
+	for i := len(defs) - 1; i >= 0; i-- {
+		if defs[i].sql != "" && defs[i].from.Compare(last) >= 0 && defs[i].to.Compare(pos) <= 0 {
+			return defs[i].sql, true
+		}
+	}
+	return "", false
+}
+
+// current tells if the table was looked up since the last DDL changing it
+func (d *tableDefinitions) current(tbKey string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defs := d.defs[tbKey]
+	if len(defs) == 0 {
+		return false
+	}
+	changes := d.changes[tbKey]
+	return len(changes) == 0 || defs[len(defs)-1].from.Compare(changes[len(changes)-1]) >= 0
+}
+
+// captureDefinition reads the definition of a table from the server, with the binlog positions around it
+func (s *Session) captureDefinition(db, tb string) {
+	key := getTableName(db, tb)
+	from, _, err := s.getCurrentPosition()
+	if err != nil {
+		logrus.Infof("no definition of %s, failed to get binlog position, err=%s", key, err.Error())
+		return
+	}
+	def, err := s.showCreateTable(db, tb)
+	if err != nil {
+		// not looked up again until the next DDL on it
+		logrus.Infof("no definition of %s, err=%s", key, err.Error())
+	}
+	to, _, err := s.getCurrentPosition()
+	if err != nil {
+		logrus.Infof("no definition of %s, failed to get binlog position, err=%s", key, err.Error())
+		return
+	}
+	s.definitions.add(key, tableDefinition{from: from, to: to, sql: def})
+}
+
+// trackDefinitions records the tables changed by the DDL query of stmts, which starts at start and ends at pos.
+// Their definitions after it are taken from the query when it tells them, else read from the server if live.
+func (s *Session) trackDefinitions(pos mysql.Position, start uint32, schema, query string, stmts []ast.StmtNode, live bool) {
+	before := mysql.Position{Name: pos.Name, Pos: start}
+	known := map[string]string{}
+	for _, stmt := range stmts {
+		switch st := stmt.(type) {
+		case *ast.CreateTableStmt:
+			db, tb := tableOf(st.Table, schema)
+			switch {
+			case st.IfNotExists && s.tableExists(getTableName(db, tb), before):
+			case st.ReferTable != nil:
+				rdb, rtb := tableOf(st.ReferTable, schema)
+				if def, ok := s.definitions.at(getTableName(rdb, rtb), before); ok {
+					known[getTableName(db, tb)] = def
+				}
+			case st.Select == nil && len(stmts) == 1:
+				known[getTableName(db, tb)] = query
+			}
+		case *ast.RenameTableStmt:
+			for _, t2t := range st.TableToTables {
+				oldDB, oldTb := tableOf(t2t.OldTable, schema)
+				newDB, newTb := tableOf(t2t.NewTable, schema)
+				if def, ok := s.definitions.at(getTableName(oldDB, oldTb), before); ok {
+					known[getTableName(newDB, newTb)] = def
+				}
+			}
+		}
+	}
+
+	tables := s.changedTables(stmts, schema, before)
+	for _, tb := range tables {
+		s.definitions.changed(getTableName(tb[0], tb[1]), pos)
+	}
+	for key, def := range known {
+		s.definitions.add(key, tableDefinition{from: pos, to: pos, sql: def})
+	}
+	if !live {
+		return
+	}
+	for _, tb := range tables {
+		key := getTableName(tb[0], tb[1])
+		if _, ok := known[key]; ok || !s.tableExists(key, pos) {
+			continue
+		}
+		s.captureDefinition(tb[0], tb[1])
+	}
+}
+
+func (s *Session) tableExists(tbKey string, pos mysql.Position) bool {
+	_, ok := s.tableinfo.lookup(tbKey, pos)
+	return ok
+}
+
+// changedTables returns the tables whose definition the statements change, as db, table
+func (s *Session) changedTables(stmts []ast.StmtNode, schema string, before mysql.Position) [][2]string {
+	var tables [][2]string
+	add := func(tn *ast.TableName) {
+		db, tb := tableOf(tn, schema)
+		tables = append(tables, [2]string{db, tb})
+	}
+	for _, stmt := range stmts {
+		switch st := stmt.(type) {
+		case *ast.CreateTableStmt:
+			db, tb := tableOf(st.Table, schema)
+			if !st.IfNotExists || !s.tableExists(getTableName(db, tb), before) {
+				add(st.Table)
+			}
+		case *ast.AlterTableStmt:
+			add(st.Table)
+			for _, spec := range st.Specs {
+				if spec.Tp == ast.AlterTableRenameTable {
+					add(spec.NewTable)
+				}
+			}
+		case *ast.DropTableStmt:
+			if !st.IsView {
+				for _, tn := range st.Tables {
+					add(tn)
+				}
+			}
+		case *ast.RenameTableStmt:
+			for _, t2t := range st.TableToTables {
+				add(t2t.OldTable)
+				add(t2t.NewTable)
+			}
+		case *ast.CreateIndexStmt:
+			add(st.Table)
+		case *ast.DropIndexStmt:
+			add(st.Table)
+		case *ast.DropDatabaseStmt:
+			for _, tb := range s.tableinfo.tablesIn(st.Name, before) {
+				tables = append(tables, [2]string{st.Name, tb})
+			}
+		}
+	}
+	return tables
+}
+
+// snapshotDDLTables reads the definitions of the tables given to WithDDLRollback at Start,
+// the other tables are read when the binlog shows them first
+func (s *Session) snapshotDDLTables() error {
+	if len(s.conf.DDLTables) == 0 {
+		return nil
+	}
+	allTables, err := s.getTableNames()
+	if err != nil {
+		return fmt.Errorf("failed to get table names, err=%s", err.Error())
+	}
+	cnt := 0
+	for db, tables := range allTables {
+		for _, tb := range tables {
+			if ContainsString(s.conf.DDLTables, db) || ContainsString(s.conf.DDLTables, getTableName(db, tb)) {
+				s.captureDefinition(db, tb)
+				cnt++
+			}
+		}
+	}
+	logrus.Infof("took SHOW CREATE TABLE snapshots of %d tables", cnt)
+	return nil
+}
@@ -1,14 +1,17 @@
 package mysqlbinlog
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"github.com/pingcap/parser"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/volatiletech/null.v6"
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 )
 
 type fieldInfo struct {
@@ -36,20 +39,140 @@ func (s tblInfoJson) getOneUniqueKey() keyInfo {
 	}
 }
 
+// clone returns a deep copy of the table structure, for DDL to change
+func (s tblInfoJson) clone() *tblInfoJson {
+	c := &tblInfoJson{
+		Columns:       append([]fieldInfo{}, s.Columns...),
+		PrimaryKey:    append(keyInfo{}, s.PrimaryKey...),
+		AutoIncrement: s.AutoIncrement,
+	}
+	for _, k := range s.UniqueKeys {
+		c.UniqueKeys = append(c.UniqueKeys, append(keyInfo{}, k...))
+	}
+	return c
+}
+
 type tablesColumnsInfo struct {
+	// mu guards tableInfos and versions, the listener, the generator and the user goroutines share them.
+	// tableInfos is replaced as a whole on reload, and its structures are not changed once in.
+	mu         sync.RWMutex
 	tableInfos map[string]*tblInfoJson //{db.tb:TblInfoJson}
+
+	// table structures changed by DDL in the binlog, in binlog order, they override tableInfos from their positions on
+	versions  map[string][]tableVersion
+	ddlPos    mysql.Position // end of the last DDL applied, a reconnect may replay it
+	ddlParser *parser.Parser
+}
+
+// tableVersion is the structure of a table from the end of a DDL, nil info means the table is dropped
+type tableVersion struct {
+	pos  mysql.Position
+	info *tblInfoJson
 }
 
 func (s *tablesColumnsInfo) getTableInfo(schema string, table string, binlog string, spos uint32, epos uint32) (*tblInfoJson, error) {
 	myPos := mysql.Position{Name: binlog, Pos: epos}
 	tbKey := getTableName(schema, table)
-	tbDef, ok := s.tableInfos[tbKey]
+	tbDef, ok := s.lookup(tbKey, myPos)
 	if !ok {
 		return nil, fmt.Errorf("table struct not found for %s, maybe it was dropped. Skip it, binlog position info: %s", tbKey, myPos.String())
 	}
 	return tbDef, nil
 }
 
+// lookup returns the structure of the table in effect at pos
+func (s *tablesColumnsInfo) lookup(tbKey string, pos mysql.Position) (*tblInfoJson, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions := s.versions[tbKey]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].pos.Compare(pos) <= 0 {
+			return versions[i].info, versions[i].info != nil
+		}
+	}
+	tbDef, ok := s.tableInfos[tbKey]
+	return tbDef, ok
+}
+
+// tablesIn returns the tables of schema at pos
+func (s *tablesColumnsInfo) tablesIn(schema string, pos mysql.Position) []string {
+	prefix := getTableName(schema, "")
+	keys := map[string]bool{}
+	s.mu.RLock()
+	for key := range s.tableInfos {
+		keys[key] = true
+	}
+	for key := range s.versions {
+		keys[key] = true
+	}
+	s.mu.RUnlock()
+
+	var tables []string
+	for key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if _, ok := s.lookup(key, pos); ok {
+			tables = append(tables, strings.TrimPrefix(key, prefix))
+		}
+	}
+	return tables
+}
+
+// replace swaps in the structures reloaded from the server. They are newer than any DDL seen so far, so the
+// versions recorded from DDL are dropped, except those the events after consumed, still queued, are decoded with.
+func (s *tablesColumnsInfo) replace(tableInfos map[string]*tblInfoJson, consumed mysql.Position) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tableInfos = tableInfos
+	for tbKey, versions := range s.versions {
+		// the version in effect at consumed is still needed if a later one follows
+		first := 0
+		for i, v := range versions {
+			if v.pos.Compare(consumed) <= 0 {
+				first = i
+			}
+		}
+		if versions[len(versions)-1].pos.Compare(consumed) <= 0 {
+			delete(s.versions, tbKey)
+			continue
+		}
+		s.versions[tbKey] = versions[first:]
+	}
+}
+
+// tables returns a copy of the structures loaded from the server
+func (s *tablesColumnsInfo) tables() map[string]*tblInfoJson {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tables := make(map[string]*tblInfoJson, len(s.tableInfos))
+	for key, info := range s.tableInfos {
+		tables[key] = info
+	}
+	return tables
+}
+
+// autoIncrement returns the AUTO_INCREMENT of the table loaded from the server
+func (s *tablesColumnsInfo) autoIncrement(tbKey string) (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.tableInfos[tbKey]
+	if !ok || info == nil {
+		return 0, false
+	}
+	return info.AutoIncrement, true
+}
+
+// setVersion records the structure of the table from pos on, DDL arrive in binlog order
+func (s *tablesColumnsInfo) setVersion(tbKey string, pos mysql.Position, info *tblInfoJson) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.versions == nil {
+		s.versions = map[string][]tableVersion{}
+	}
+	s.versions[tbKey] = append(s.versions[tbKey], tableVersion{pos: pos, info: info})
+}
+
 func (s *tablesColumnsInfo) checkAndCreateTblKey(schema, table string) bool {
 	if len(s.tableInfos) < 1 {
 		s.tableInfos = map[string]*tblInfoJson{}
@@ -59,8 +182,7 @@ func (s *tablesColumnsInfo) checkAndCreateTblKey(schema, table string) bool {
 	return ok
 }
 
-func (s *tablesColumnsInfo) getTableFields(dbTbs map[string][]string, batchCnt int) error {
-	con := getDBCon()
+func (s *tablesColumnsInfo) getTableFields(con *sql.DB, dbTbs map[string][]string, batchCnt int) error {
 	var (
 		dbName         string
 		tbName         string
@@ -118,8 +240,7 @@ func (s *tablesColumnsInfo) getTableFields(dbTbs map[string][]string, batchCnt i
 	return nil
 }
 
-func (s *tablesColumnsInfo) getTableKeys(dbTbs map[string][]string, batchCnt int) (err error) {
-	con := getDBCon()
+func (s *tablesColumnsInfo) getTableKeys(con *sql.DB, dbTbs map[string][]string, batchCnt int) (err error) {
 	var (
 		dbName, tbName, kName, colName, ktype string
 		colPos                                int
@@ -234,8 +355,7 @@ func (s *tablesColumnsInfo) getTableKeys(dbTbs map[string][]string, batchCnt int
 	return nil
 }
 
-func (s *tablesColumnsInfo) getTableAutoIncrements(dbTbs map[string][]string, batchCnt int) error {
-	con := getDBCon()
+func (s *tablesColumnsInfo) getTableAutoIncrements(con *sql.DB, dbTbs map[string][]string, batchCnt int) error {
 	logrus.Info("getting auto_increments from mysql")
 	querySqls := getFieldOrKeyQuerySqls(autoIncrementsSQL, dbTbs, batchCnt)
 	for _, oneQuery := range querySqls {
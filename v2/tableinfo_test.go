@@ -0,0 +1,92 @@
+package mysqlbinlog
+
+import (
+	"testing"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+)
+
+func columnDef(name string) *ast.ColumnDef {
+	return &ast.ColumnDef{Name: &ast.ColumnName{Name: model.CIStr{O: name, L: name}}}
+}
+
+func columnNames(info *tblInfoJson) []string {
+	var names []string
+	for _, col := range info.Columns {
+		names = append(names, col.FieldName)
+	}
+	return names
+}
+
+func TestApplyStmtsVersions(t *testing.T) {
+	var s tablesColumnsInfo
+	s.replace(map[string]*tblInfoJson{"shop.orders": {Columns: []fieldInfo{{FieldName: "id", FieldType: "int"}}, PrimaryKey: keyInfo{"id"}}}, binlogPos(0))
+
+	s.applyStmts(binlogPos(100), "shop", []ast.StmtNode{&ast.AlterTableStmt{Table: tableName("", "orders"),
+		Specs: []*ast.AlterTableSpec{{Tp: ast.AlterTableAddColumns, NewColumns: []*ast.ColumnDef{columnDef("note")}}}}})
+	s.applyStmts(binlogPos(200), "shop", []ast.StmtNode{&ast.RenameTableStmt{TableToTables: []*ast.TableToTable{{OldTable: tableName("", "orders"), NewTable: tableName("", "orders2")}}}})
+	s.applyStmts(binlogPos(300), "shop", []ast.StmtNode{&ast.DropTableStmt{Tables: []*ast.TableName{tableName("", "orders2")}}})
+
+	tests := []struct {
+		table string
+		pos   uint32
+		want  []string // nil if the table does not exist
+	}{
+		{"shop.orders", 50, []string{"id"}},
+		{"shop.orders", 100, []string{"id", "note"}},
+		{"shop.orders", 250, nil},
+		{"shop.orders2", 150, nil},
+		{"shop.orders2", 250, []string{"id", "note"}},
+		{"shop.orders2", 300, nil},
+	}
+	for _, tc := range tests {
+		info, ok := s.lookup(tc.table, binlogPos(tc.pos))
+		if ok != (tc.want != nil) {
+			t.Errorf("lookup(%s, %d) exists = %v, want %v", tc.table, tc.pos, ok, tc.want != nil)
+			continue
+		}
+		if ok && len(columnNames(info)) != len(tc.want) {
+			t.Errorf("lookup(%s, %d) = %v, want %v", tc.table, tc.pos, columnNames(info), tc.want)
+		}
+	}
+	// the loaded structure is left alone
+	if info, _ := s.lookup("shop.orders", binlogPos(50)); len(info.Columns) != 1 || info.PrimaryKey[0] != "id" {
+		t.Errorf("structure before the DDL = %+v, want the loaded one", info)
+	}
+}
+
+func TestReplaceKeepsQueuedVersions(t *testing.T) {
+	var s tablesColumnsInfo
+	s.replace(map[string]*tblInfoJson{
+		"shop.orders": {Columns: []fieldInfo{{FieldName: "id"}}},
+		"shop.items":  {Columns: []fieldInfo{{FieldName: "id"}}},
+	}, binlogPos(0))
+	addNote := func(pos uint32, table string) {
+		s.applyStmts(binlogPos(pos), "shop", []ast.StmtNode{&ast.AlterTableStmt{Table: tableName("", table),
+			Specs: []*ast.AlterTableSpec{{Tp: ast.AlterTableAddColumns, NewColumns: []*ast.ColumnDef{columnDef("note" + table)}}}}})
+	}
+	addNote(100, "orders")
+	addNote(300, "orders")
+	addNote(100, "items")
+
+	// reloaded while the generator is at 200, the events up to the second ALTER of orders are still queued
+	reloaded := map[string]*tblInfoJson{
+		"shop.orders": {Columns: []fieldInfo{{FieldName: "id"}, {FieldName: "noteorders"}, {FieldName: "noteorders"}}},
+		"shop.items":  {Columns: []fieldInfo{{FieldName: "id"}, {FieldName: "noteitems"}}},
+	}
+	s.replace(reloaded, binlogPos(200))
+
+	if info, _ := s.lookup("shop.orders", binlogPos(250)); len(info.Columns) != 2 {
+		t.Errorf("orders at 250 has %d columns, want 2 of the version in effect before the queued DDL", len(info.Columns))
+	}
+	if info, _ := s.lookup("shop.orders", binlogPos(350)); len(info.Columns) != 3 {
+		t.Errorf("orders at 350 has %d columns, want 3", len(info.Columns))
+	}
+	if _, ok := s.versions["shop.items"]; ok {
+		t.Error("versions of items are kept, no queued event needs them")
+	}
+	if info, _ := s.lookup("shop.items", binlogPos(250)); info != reloaded["shop.items"] {
+		t.Errorf("items at 250 = %+v, want the reloaded structure", info)
+	}
+}
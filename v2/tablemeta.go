@@ -0,0 +1,103 @@
+package mysqlbinlog
+
+import (
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// binaryCollationID is the collation of BLOB columns, TEXT columns have a character collation
+const binaryCollationID = 63
+
+// With binlog_row_metadata=FULL (MySQL 8.0.1+, MariaDB 10.5+) the TableMapEvent carries the column names,
+// signedness, charsets and primary key of the table as it is when the rows were written. Such events
+// do not depend on the table structure loaded at Start(), so DDL in the middle does not break them.
+
+// metadataColumns returns the columns and the unique key of tbMap from its optional metadata, nil if the
+// event has no column names. tbInfo, which may be nil, only completes what the metadata lacks.
+func metadataColumns(tbMap *replication.TableMapEvent, tbInfo *tblInfoJson) ([]fieldInfo, keyInfo) {
+	names := tbMap.ColumnNameString()
+	if len(names) != int(tbMap.ColumnCount) || len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]fieldInfo{}
+	if tbInfo != nil {
+		for _, col := range tbInfo.Columns {
+			known[col.FieldName] = col
+		}
+	}
+	collations := tbMap.CollationMap()
+
+	cols := make([]fieldInfo, len(names))
+	for i, name := range names {
+		col := fieldInfo{FieldName: name}
+		if k, ok := known[name]; ok {
+			// generated columns are not in the metadata
+			col.FieldType, col.Extra = k.FieldType, k.Extra
+		}
+		if collation, ok := collations[i]; ok && tbMap.ColumnType[i] == mysql.MYSQL_TYPE_BLOB {
+			col.FieldType = "blob"
+			if collation != binaryCollationID {
+				col.FieldType = "text"
+			}
+		}
+		cols[i] = col
+	}
+
+	var key keyInfo
+	for _, idx := range tbMap.PrimaryKey {
+		if int(idx) < len(names) {
+			key = append(key, names[idx])
+		}
+	}
+	if len(key) == 0 && tbInfo != nil {
+		// tables without a primary key, use the unique key loaded at Start() if it still exists
+		key = tbInfo.getOneUniqueKey()
+		for _, colName := range key {
+			if !containsField(cols, colName) {
+				key = nil
+				break
+			}
+		}
+	}
+	return cols, key
+}
+
+func containsField(cols []fieldInfo, name string) bool {
+	for _, col := range cols {
+		if col.FieldName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fixUnsignedValues converts the values of unsigned integer columns, which the binlog library decodes as signed,
+// back to unsigned ones. It needs the signedness in the metadata, otherwise rows are left as they are.
+func fixUnsignedValues(rEv *replication.RowsEvent) {
+	unsigned := rEv.Table.UnsignedMap()
+	if len(unsigned) == 0 {
+		return
+	}
+	for _, row := range rEv.Rows {
+		for ci, v := range row {
+			if !unsigned[ci] {
+				continue
+			}
+			switch n := v.(type) {
+			case int8:
+				row[ci] = uint8(n)
+			case int16:
+				row[ci] = uint16(n)
+			case int32:
+				if rEv.Table.ColumnType[ci] == mysql.MYSQL_TYPE_INT24 {
+					row[ci] = uint32(n) & 0xffffff
+				} else {
+					row[ci] = uint32(n)
+				}
+			case int64:
+				row[ci] = uint64(n)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mysqlbinlog
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// filesTableMap maps shop.files (id INT, name VARCHAR, data BLOB, body TEXT) with full metadata
+func filesTableMap() *replication.TableMapEvent {
+	return &replication.TableMapEvent{
+		Schema:      []byte("shop"),
+		Table:       []byte("files"),
+		ColumnCount: 4,
+		ColumnType:  []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_BLOB},
+		ColumnMeta:  []uint16{0, 255, 2, 2},
+		ColumnName:  [][]byte{[]byte("id"), []byte("name"), []byte("data"), []byte("body")},
+		// utf8mb4 by default, binary for the second character column
+		DefaultCharset: []uint64{45, 1, binaryCollationID},
+	}
+}
+
+func TestMetadataColumns(t *testing.T) {
+	tbInfo := &tblInfoJson{
+		Columns:    []fieldInfo{{FieldName: "id", FieldType: "int unsigned"}, {FieldName: "name", FieldType: "varchar(64)"}, {FieldName: "gone", FieldType: "int"}},
+		UniqueKeys: []keyInfo{{"name"}},
+	}
+	wantCols := []fieldInfo{{FieldName: "id", FieldType: "int unsigned"}, {FieldName: "name", FieldType: "varchar(64)"}, {FieldName: "data", FieldType: "blob"}, {FieldName: "body", FieldType: "text"}}
+
+	tbMap := filesTableMap()
+	tbMap.PrimaryKey = []uint64{0}
+	cols, key := metadataColumns(tbMap, tbInfo)
+	if !reflect.DeepEqual(cols, wantCols) {
+		t.Errorf("columns = %+v, want %+v", cols, wantCols)
+	}
+	if want := (keyInfo{"id"}); !reflect.DeepEqual(key, want) {
+		t.Errorf("key = %v, want the primary key %v", key, want)
+	}
+
+	// no primary key in the metadata, fall back to the unique key loaded at Start()
+	if _, key := metadataColumns(filesTableMap(), tbInfo); !reflect.DeepEqual(key, keyInfo{"name"}) {
+		t.Errorf("key = %v, want the unique key of the table info", key)
+	}
+	dropped := &tblInfoJson{UniqueKeys: []keyInfo{{"gone"}}}
+	if _, key := metadataColumns(filesTableMap(), dropped); key != nil {
+		t.Errorf("key = %v, want none for a unique key on a dropped column", key)
+	}
+
+	// without the table info only the metadata types are known
+	cols, key = metadataColumns(filesTableMap(), nil)
+	if cols[0].FieldType != "" || cols[2].FieldType != "blob" || cols[3].FieldType != "text" || key != nil {
+		t.Errorf("columns = %+v key = %v, want the BLOB/TEXT types only and no key", cols, key)
+	}
+
+	noNames := filesTableMap()
+	noNames.ColumnName = nil
+	if cols, key := metadataColumns(noNames, tbInfo); cols != nil || key != nil {
+		t.Errorf("metadataColumns without column names = %+v, %v, want nil", cols, key)
+	}
+}
+
+func TestFixUnsignedValues(t *testing.T) {
+	table := &replication.TableMapEvent{
+		ColumnCount: 7,
+		ColumnType: []byte{mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG,
+			mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_LONG},
+		ColumnMeta: []uint16{0, 0, 0, 0, 0, 255, 0},
+		// one bit per numeric column, the first five unsigned, the last signed
+		SignednessBitmap: []byte{0xf8},
+	}
+	row := func() []interface{} {
+		return []interface{}{int8(-1), int16(-1), int32(-1), int32(-1), int64(-1), "x", int32(-1)}
+	}
+	ev := &replication.RowsEvent{Table: table, Rows: [][]interface{}{row(), {nil, int16(1), int32(2), int32(3), int64(4), nil, int32(5)}}}
+	fixUnsignedValues(ev)
+	want := [][]interface{}{
+		{uint8(0xff), uint16(0xffff), uint32(0xffffff), uint32(0xffffffff), uint64(0xffffffffffffffff), "x", int32(-1)},
+		{nil, uint16(1), uint32(2), uint32(3), uint64(4), nil, int32(5)},
+	}
+	if !reflect.DeepEqual(ev.Rows, want) {
+		t.Errorf("rows = %v, want %v", ev.Rows, want)
+	}
+
+	// no signedness in the metadata, the rows are left as they are
+	table.SignednessBitmap = nil
+	ev = &replication.RowsEvent{Table: table, Rows: [][]interface{}{row()}}
+	fixUnsignedValues(ev)
+	if !reflect.DeepEqual(ev.Rows, [][]interface{}{row()}) {
+		t.Errorf("rows = %v, want them untouched", ev.Rows)
+	}
+}
@@ -2,12 +2,22 @@ package mysqlbinlog
 
 import (
 	"fmt"
+	"strings"
 )
 
 func getTableName(schema, table string) string {
 	return fmt.Sprintf("%s.%s", schema, table)
 }
 
+// quoteName returns db.table quoted with backticks, for SQLs built by hand
+func quoteName(schema, table string) string {
+	return quoteIdent(schema) + "." + quoteIdent(table)
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
 func MinValue(nums ...int) int {
 	min := nums[0]
 	for _, v := range nums {
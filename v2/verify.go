@@ -0,0 +1,175 @@
+package mysqlbinlog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// VerifyReport is the result of comparing the tables touched by a Rollback with their checksums taken at Begin
+type VerifyReport struct {
+	MarkerID   int64
+	Tables     []string // tables checked, db.table
+	Skipped    []string // tables of the rollback without a checksum taken at Begin, e.g. created since then
+	Mismatches []TableMismatch
+}
+
+// OK tells whether all checked tables are back to their state at Begin
+func (r *VerifyReport) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+// TableMismatch is a table whose content differs from Begin after Rollback
+type TableMismatch struct {
+	DB     string
+	Table  string
+	Before int64
+	After  int64
+	Exists bool // false if the table is gone after Rollback
+}
+
+// VerifyError is returned by Rollback in verify mode when some tables differ from Begin,
+// the rollback SQLs are executed already.
+type VerifyError struct {
+	Report       *VerifyReport
+	Irreversible *IrreversibleDDLError // DDL of the same Rollback which can not be reverted, nil if none
+}
+
+func (e *VerifyError) Error() string {
+	var tables []string
+	for _, m := range e.Report.Mismatches {
+		tables = append(tables, getTableName(m.DB, m.Table))
+	}
+	msg := fmt.Sprintf("rollback verification failed, markerID=%d, %d table(s) differ from Begin: %s",
+		e.Report.MarkerID, len(tables), strings.Join(tables, ", "))
+	if e.Irreversible != nil {
+		msg += "; " + e.Irreversible.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the *IrreversibleDDLError of the same Rollback, so errors.As finds both
+func (e *VerifyError) Unwrap() error {
+	if e.Irreversible == nil {
+		return nil
+	}
+	return e.Irreversible
+}
+
+type tableChecksum struct {
+	db, table string
+	sum       int64
+}
+
+// LastVerifyReport returns the report of the last verified Rollback, nil if none yet.
+func (s *Session) LastVerifyReport() *VerifyReport {
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+	return s.lastVerifyReport
+}
+
+// verifyTables returns the tables checksummed at Begin: the tables tracked in tableinfo, the ones
+// touched by the cycles so far and the ones passed to WithVerify
+func (s *Session) verifyTables() []tableChecksum {
+	tables := append([]string{}, s.conf.VerifyTables...)
+	for key := range s.tableinfo.tables() {
+		if db := strings.SplitN(key, ".", 2)[0]; db != markerDatabaseName && db != shadowDatabaseName {
+			tables = append(tables, key)
+		}
+	}
+	return s.cycleTables(tables)
+}
+
+// verify recomputes the checksums of the tables in entries and compares them with the ones taken at Begin
+func (s *Session) verify(ctx context.Context, markerID int64, entries []rollbackEntry) error {
+	var tables []tableChecksum
+	var skipped []string
+	seen := map[string]struct{}{}
+	for _, entry := range entries {
+		if entry.Table == "" || entry.DB == markerDatabaseName || entry.DB == shadowDatabaseName {
+			continue
+		}
+		key := getTableName(entry.DB, entry.Table)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if _, ok := s.beginChecksums[key]; !ok {
+			// no checksum at Begin, the table did not exist or could not be checksummed then
+			skipped = append(skipped, key)
+			continue
+		}
+		tables = append(tables, tableChecksum{db: entry.DB, table: entry.Table})
+	}
+
+	checksums, err := s.checksumTables(ctx, tables)
+	if err != nil {
+		return s.wrapCtxErr(ctx, markerID, fmt.Errorf("failed to checksum tables for verification, markerID=%d err=%w", markerID, err))
+	}
+
+	report := &VerifyReport{MarkerID: markerID, Skipped: skipped}
+	for _, tb := range tables {
+		key := getTableName(tb.db, tb.table)
+		report.Tables = append(report.Tables, key)
+		before := s.beginChecksums[key]
+		after, ok := checksums[key]
+		if !ok || after.sum != before.sum {
+			report.Mismatches = append(report.Mismatches, TableMismatch{DB: tb.db, Table: tb.table, Before: before.sum, After: after.sum, Exists: ok})
+		}
+	}
+	sort.Strings(report.Tables)
+	sort.Strings(report.Skipped)
+	if len(report.Skipped) > 0 {
+		logrus.Warnf("tables %s have no checksum taken at Begin, they are not verified, markerID=%d", strings.Join(report.Skipped, ", "), markerID)
+	}
+	s.lastVerifyReport = report
+
+	if !report.OK() {
+		return &VerifyError{Report: report}
+	}
+	logrus.Infof("rollback verified, markerID=%d, %d table(s) checked", markerID, len(report.Tables))
+	return nil
+}
+
+// checksumTables runs CHECKSUM TABLE for tables, a table which does not exist is left out of the result
+func (s *Session) checksumTables(ctx context.Context, tables []tableChecksum) (map[string]tableChecksum, error) {
+	checksums := map[string]tableChecksum{}
+	if len(tables) == 0 {
+		return checksums, nil
+	}
+	con, err := s.getDBCon()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(tables))
+	byName := map[string]tableChecksum{}
+	for i, tb := range tables {
+		names[i] = quoteName(tb.db, tb.table)
+		byName[getTableName(tb.db, tb.table)] = tb
+	}
+	rows, err := con.QueryContext(ctx, "CHECKSUM TABLE "+strings.Join(names, ", "))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var sum sql.NullInt64
+		if err := rows.Scan(&name, &sum); err != nil {
+			return nil, err
+		}
+		tb, ok := byName[name]
+		if !ok || !sum.Valid {
+			continue
+		}
+		tb.sum = sum.Int64
+		checksums[name] = tb
+	}
+	return checksums, rows.Err()
+}
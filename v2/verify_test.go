@@ -0,0 +1,87 @@
+package mysqlbinlog
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func TestCycleTables(t *testing.T) {
+	s := &Session{}
+	s.noteTouched([]rollbackEntry{
+		{DB: "shop", Table: "orders"},
+		{DB: markerDatabaseName, Table: "marker"},
+		{DB: shadowDatabaseName, Table: "shop__orders"},
+		{DB: "shop", Table: "items"},
+		{DB: "shop", Table: "orders"},
+		{DB: "shop"}, // DROP DATABASE
+	})
+	got := s.cycleTables([]string{"shop.users", "shop.items", "nodb"})
+	want := []tableChecksum{{db: "shop", table: "items"}, {db: "shop", table: "orders"}, {db: "shop", table: "users"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cycleTables = %v, want %v", got, want)
+	}
+}
+
+func TestVerifyTables(t *testing.T) {
+	s := &Session{conf: &ConfCmd{VerifyTables: []string{"shop.audit"}}}
+	s.tableinfo.replace(map[string]*tblInfoJson{
+		"shop.orders":                    {},
+		"shop.items":                     {},
+		markerDatabaseName + ".marker":   {},
+		shadowDatabaseName + ".shop__ab": {},
+	}, mysql.Position{})
+	s.noteTouched([]rollbackEntry{{DB: "shop", Table: "created"}})
+
+	got := s.verifyTables()
+	want := []tableChecksum{{db: "shop", table: "audit"}, {db: "shop", table: "created"}, {db: "shop", table: "items"}, {db: "shop", table: "orders"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("verifyTables = %v, want %v", got, want)
+	}
+}
+
+func TestVerifyReportsSkippedTables(t *testing.T) {
+	s := &Session{conf: &ConfCmd{}, beginChecksums: map[string]tableChecksum{}}
+	err := s.verify(context.Background(), 3, []rollbackEntry{
+		{DB: "shop", Table: "new_table"},
+		{DB: "shop", Table: "new_table"},
+		{DB: markerDatabaseName, Table: "marker"},
+		{DB: "shop"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := s.LastVerifyReport()
+	if !reflect.DeepEqual(report.Skipped, []string{"shop.new_table"}) || len(report.Tables) != 0 {
+		t.Errorf("report %+v, want shop.new_table skipped and nothing checked", report)
+	}
+}
+
+func TestVerifyErrorKeepsIrreversible(t *testing.T) {
+	irreversible := &IrreversibleDDLError{MarkerID: 3, Statements: []RollbackStatement{{Query: "DROP TABLE t", Pos: "binlog.000001 120-300", Irreversible: "no definition"}}}
+	var err error = &VerifyError{
+		Report:       &VerifyReport{MarkerID: 3, Mismatches: []TableMismatch{{DB: "shop", Table: "orders"}}},
+		Irreversible: irreversible,
+	}
+
+	var verifyErr *VerifyError
+	if !errors.As(err, &verifyErr) {
+		t.Fatal("errors.As(*VerifyError) = false")
+	}
+	var irreversibleErr *IrreversibleDDLError
+	if !errors.As(err, &irreversibleErr) || irreversibleErr != irreversible {
+		t.Fatal("errors.As(*IrreversibleDDLError) does not find the wrapped error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "shop.orders") || !strings.Contains(msg, "DROP TABLE t") {
+		t.Errorf("Error() = %q, want both the mismatched table and the DDL", msg)
+	}
+
+	var alone error = &VerifyError{Report: &VerifyReport{MarkerID: 3}}
+	if errors.Unwrap(alone) != nil {
+		t.Error("Unwrap of a VerifyError without DDL left behind is not nil")
+	}
+}